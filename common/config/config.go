@@ -0,0 +1,267 @@
+// Package config loads the settings of a service into a flat struct whose fields are described by tags:
+//
+//	type Config struct {
+//		Brokers  []string      `yaml:"kafka-brokers" default:"kafka1:9092" validate:"min=1"`
+//		Timeout  time.Duration `yaml:"timeout" default:"2s"`
+//		Password string        `yaml:"redis-password" secret:"true"`
+//		Exporter string        `yaml:"traces-exporter" env:"OTEL_TRACES_EXPORTER"`
+//	}
+//
+// A field is set from, in increasing order of precedence, its `default` tag, its key in the yaml file,
+// its environment variable and its command line flag. The key of a field is the name of its yaml tag,
+// its flag is `-key` and its environment variable is the key in upper case with underscores instead of
+// dashes, e.g KAFKA_BROKERS, unless an `env` tag names it. Lists are comma separated outside of the file.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// FileFlag is the flag giving the path of the yaml file
+	FileFlag = "config"
+	// PrintFlag is the flag printing the config, secrets redacted, instead of starting the service
+	PrintFlag = "print-config"
+
+	// Redacted replaces the value of the secret fields when the config is printed
+	Redacted = "REDACTED"
+)
+
+// ErrPrinted is returned by Load once the config has been printed because PrintFlag was passed
+var ErrPrinted = errors.New("config printed")
+
+// field is a setting of the config struct
+type field struct {
+	key    string
+	env    string
+	def    string
+	secret bool
+	value  reflect.Value
+}
+
+// Load fills c, a pointer to a struct, from the defaults, the yaml file at defaultFile or the path given by
+// FileFlag, the environment and args, the command line arguments without the program name, then validates
+// it with the `validate` tags. The file is optional when defaultFile is empty and no path is given.
+// With PrintFlag, it prints c to out and returns ErrPrinted.
+func Load(c interface{}, defaultFile string, args []string, out io.Writer) error {
+	fields, err := fieldsOf(c)
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	file := flags.String(FileFlag, defaultFile, "path of the yaml config file")
+	print := flags.Bool(PrintFlag, false, "print the config, secrets redacted, and exit")
+	for _, f := range fields {
+		flags.String(f.key, f.def, fmt.Sprintf("overrides %s, also set by $%s", f.key, f.env))
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		if err := f.set(f.def); err != nil {
+			return fmt.Errorf("default of %s: %v", f.key, err)
+		}
+	}
+
+	if *file != "" {
+		source, err := ioutil.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(source, c); err != nil {
+			return fmt.Errorf("%s: %v", *file, err)
+		}
+	}
+
+	for _, f := range fields {
+		if v, ok := os.LookupEnv(f.env); ok {
+			if err := f.set(v); err != nil {
+				return fmt.Errorf("$%s: %v", f.env, err)
+			}
+		}
+	}
+
+	byKey := map[string]field{}
+	for _, f := range fields {
+		byKey[f.key] = f
+	}
+
+	var flagErr error
+	flags.Visit(func(fl *flag.Flag) {
+		f, ok := byKey[fl.Name]
+		if !ok || flagErr != nil {
+			return
+		}
+		if err := f.set(fl.Value.String()); err != nil {
+			flagErr = fmt.Errorf("-%s: %v", f.key, err)
+		}
+	})
+	if flagErr != nil {
+		return flagErr
+	}
+
+	if *print {
+		if err := Print(out, c); err != nil {
+			return err
+		}
+		return ErrPrinted
+	}
+
+	return validator.New().Struct(c)
+}
+
+// MustLoad loads c from the command line and the environment, it exits once the config is printed
+// and when it is invalid, rather than have the service fail while it is running
+func MustLoad(c interface{}, defaultFile string) {
+	err := Load(c, defaultFile, os.Args[1:], os.Stdout)
+	if err == ErrPrinted {
+		os.Exit(0)
+	}
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+		os.Exit(2)
+	}
+}
+
+// Print writes c to w as yaml, with the value of its secret fields replaced by Redacted
+func Print(w io.Writer, c interface{}) error {
+	fields, err := fieldsOf(c)
+	if err != nil {
+		return err
+	}
+
+	out := yaml.MapSlice{}
+	for _, f := range fields {
+		var v interface{}
+		switch {
+		case f.secret && !f.value.IsZero():
+			v = Redacted
+		case f.value.Type() == durationType:
+			v = f.value.Interface().(time.Duration).String()
+		default:
+			v = f.value.Interface()
+		}
+		out = append(out, yaml.MapItem{Key: f.key, Value: v})
+	}
+
+	b, err := yaml.Marshal(out)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// fieldsOf returns the settings of c, a pointer to a struct, in the order they are declared
+func fieldsOf(c interface{}) ([]field, error) {
+	v := reflect.ValueOf(c)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("config must be a pointer to a struct, got %T", c)
+	}
+	v = v.Elem()
+
+	var fields []field
+	for i := 0; i < v.NumField(); i++ {
+		t := v.Type().Field(i)
+
+		key := strings.Split(t.Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+
+		env := t.Tag.Get("env")
+		if env == "" {
+			env = strings.ToUpper(strings.Replace(key, "-", "_", -1))
+		}
+
+		f := field{key: key, env: env, def: t.Tag.Get("default"), secret: t.Tag.Get("secret") == "true", value: v.Field(i)}
+		if !f.supported() {
+			return nil, fmt.Errorf("field %s: unsupported type %s", t.Name, t.Type)
+		}
+		fields = append(fields, f)
+	}
+
+	return fields, nil
+}
+
+func (f field) supported() bool {
+	switch f.value.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return f.value.Type().Elem().Kind() == reflect.String
+	}
+	return false
+}
+
+// set parses s into the field, an empty s resets it
+func (f field) set(s string) error {
+	if s == "" {
+		f.value.Set(reflect.Zero(f.value.Type()))
+		return nil
+	}
+
+	if f.value.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(int64(d))
+		return nil
+	}
+
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.value.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(i)
+	case reflect.Float64:
+		x, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		f.value.SetFloat(x)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		f.value.Set(reflect.ValueOf(items))
+	}
+
+	return nil
+}
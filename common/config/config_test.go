@@ -0,0 +1,186 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+type testConfig struct {
+	Brokers  []string      `yaml:"kafka-brokers" default:"kafka1:9092" validate:"min=1"`
+	Topic    string        `yaml:"topic" validate:"required"`
+	Retries  int           `yaml:"retries" default:"3"`
+	Timeout  time.Duration `yaml:"timeout" default:"2s"`
+	Distance float64       `yaml:"distance"`
+	Debug    bool          `yaml:"debug"`
+	Password string        `yaml:"redis-password" secret:"true"`
+	Exporter string        `yaml:"traces-exporter" env:"OTEL_TRACES_EXPORTER"`
+}
+
+func writeFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "config*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+// setenv sets the environment variables of a test and returns a function restoring them
+func setenv(env map[string]string) func() {
+	previous := map[string]*string{}
+	for k, v := range env {
+		if old, ok := os.LookupEnv(k); ok {
+			previous[k] = &old
+		} else {
+			previous[k] = nil
+		}
+		os.Setenv(k, v)
+	}
+
+	return func() {
+		for k, old := range previous {
+			if old == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *old)
+			}
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	file := writeFile(t, "topic: locations\nretries: 5\ntimeout: 10s\ndistance: 500\n")
+	defer os.Remove(file)
+
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		args    []string
+		want    testConfig
+		wantErr bool
+	}{
+		{
+			name: "defaults and file",
+			file: file,
+			want: testConfig{Brokers: []string{"kafka1:9092"}, Topic: "locations", Retries: 5, Timeout: 10 * time.Second, Distance: 500},
+		},
+		{
+			name: "environment overrides the file",
+			file: file,
+			env:  map[string]string{"KAFKA_BROKERS": "kafka1:9092, kafka2:9092", "RETRIES": "7", "OTEL_TRACES_EXPORTER": "stdout"},
+			want: testConfig{Brokers: []string{"kafka1:9092", "kafka2:9092"}, Topic: "locations", Retries: 7, Timeout: 10 * time.Second,
+				Distance: 500, Exporter: "stdout"},
+		},
+		{
+			name: "flags override the environment",
+			file: file,
+			env:  map[string]string{"RETRIES": "7"},
+			args: []string{"-retries", "9", "-debug", "true", "-timeout", "1m"},
+			want: testConfig{Brokers: []string{"kafka1:9092"}, Topic: "locations", Retries: 9, Timeout: time.Minute, Distance: 500, Debug: true},
+		},
+		{
+			name: "file given by flag",
+			args: []string{"-" + FileFlag, file},
+			want: testConfig{Brokers: []string{"kafka1:9092"}, Topic: "locations", Retries: 5, Timeout: 10 * time.Second, Distance: 500},
+		},
+		{
+			name: "no file",
+			env:  map[string]string{"TOPIC": "locations"},
+			want: testConfig{Brokers: []string{"kafka1:9092"}, Topic: "locations", Retries: 3, Timeout: 2 * time.Second},
+		},
+		{
+			name:    "missing file",
+			file:    file + ".missing",
+			wantErr: true,
+		},
+		{
+			name:    "required field missing",
+			wantErr: true,
+		},
+		{
+			name:    "list emptied",
+			file:    file,
+			env:     map[string]string{"KAFKA_BROKERS": ""},
+			wantErr: true,
+		},
+		{
+			name:    "invalid value",
+			file:    file,
+			args:    []string{"-timeout", "10"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown flag",
+			file:    file,
+			args:    []string{"-unknown", "1"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setenv(tt.env)()
+
+			got := testConfig{}
+			err := Load(&got, tt.file, tt.args, ioutil.Discard)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("was expecting an error: %t, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestLoadPrintsConfig(t *testing.T) {
+	defer setenv(map[string]string{"REDIS_PASSWORD": "hunter2"})()
+
+	out := &bytes.Buffer{}
+	c := testConfig{}
+	// The config is printed even when invalid, to see what is missing
+	if err := Load(&c, "", []string{"-" + PrintFlag}, out); err != ErrPrinted {
+		t.Fatalf("was expecting %v, got %v", ErrPrinted, err)
+	}
+
+	want := `kafka-brokers:
+- kafka1:9092
+topic: ""
+retries: 3
+timeout: 2s
+distance: 0
+debug: false
+redis-password: REDACTED
+traces-exporter: ""
+`
+	if out.String() != want {
+		t.Errorf("was expecting\n%s\ngot\n%s", want, out.String())
+	}
+}
+
+func TestLoadRejectsUnsupportedFields(t *testing.T) {
+	c := struct {
+		Routes map[string]string `yaml:"routes"`
+	}{}
+
+	if err := Load(&c, "", nil, ioutil.Discard); err == nil {
+		t.Error("was expecting an error for a map field")
+	}
+	if err := Load(c, "", nil, ioutil.Discard); err == nil {
+		t.Error("was expecting an error when the config is not a pointer")
+	}
+}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ConnectPolicy is how often a dependency that is not up yet is tried again, there is no limit
+// on the number of attempts: the service keeps trying and reports itself not ready meanwhile
+var ConnectPolicy = RetryPolicy{
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+}
+
+// ErrNotConnected is returned by a LazySender whose producer is not connected yet
+var ErrNotConnected = errors.New("not connected")
+
+// Connect calls connect until it succeeds, waiting between two attempts according to policy.
+// It only fails when ctx is done, or when policy.MaxRetries is set and all retries failed.
+func Connect(ctx context.Context, name string, policy RetryPolicy, connect func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil {
+			if attempt > 1 {
+				log.Info().Str("dependency", name).Int("attempts", attempt).Msg("connected")
+			}
+			return nil
+		}
+
+		if policy.MaxRetries > 0 && attempt > policy.MaxRetries {
+			return err
+		}
+
+		backoff := policy.Backoff(attempt)
+		log.Warn().Err(err).Str("dependency", name).Int("attempt", attempt).Dur("backoff", backoff).
+			Msg("could not connect, retrying")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// LazySender is a Sender whose producer is connected in the background, it fails with ErrNotConnected
+// until Set is called. Its Check reports it to the readiness endpoint until then.
+type LazySender struct {
+	mu     sync.RWMutex
+	sender Sender
+}
+
+func NewLazySender() *LazySender {
+	return &LazySender{}
+}
+
+// Set makes the sender send its messages with sender
+func (l *LazySender) Set(sender Sender) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sender = sender
+}
+
+func (l *LazySender) Send(ctx context.Context, topic, key, msg string) error {
+	l.mu.RLock()
+	sender := l.sender
+	l.mu.RUnlock()
+
+	if sender == nil {
+		return ErrNotConnected
+	}
+	return sender.Send(ctx, topic, key, msg)
+}
+
+// Check fails until the producer is connected
+func (l *LazySender) Check(context.Context) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.sender == nil {
+		return ErrNotConnected
+	}
+	return nil
+}
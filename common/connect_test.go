@@ -0,0 +1,81 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConnect(t *testing.T) {
+	unreachable := errors.New("unreachable")
+	policy := RetryPolicy{InitialBackoff: time.Millisecond}
+
+	tests := []struct {
+		name         string
+		failures     int
+		policy       RetryPolicy
+		wantErr      error
+		wantAttempts int
+	}{
+		{"up straight away", 0, policy, nil, 1},
+		{"up after a few attempts", 3, policy, nil, 4},
+		{"retries exhausted", 5, RetryPolicy{MaxRetries: 2, InitialBackoff: time.Millisecond}, unreachable, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := Connect(context.Background(), "test", tt.policy, func() error {
+				attempts++
+				if attempts <= tt.failures {
+					return unreachable
+				}
+				return nil
+			})
+
+			if err != tt.wantErr {
+				t.Errorf("was expecting %v, got %v", tt.wantErr, err)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("was expecting %d attempts, got %d", tt.wantAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestConnectStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := Connect(ctx, "test", RetryPolicy{InitialBackoff: time.Millisecond}, func() error {
+		return errors.New("unreachable")
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("was expecting %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestLazySender(t *testing.T) {
+	l := NewLazySender()
+
+	if err := l.Send(context.Background(), "topic", "key", "msg"); err != ErrNotConnected {
+		t.Errorf("was expecting %v before the producer is set, got %v", ErrNotConnected, err)
+	}
+	if err := l.Check(context.Background()); err != ErrNotConnected {
+		t.Errorf("was expecting the check to fail before the producer is set, got %v", err)
+	}
+
+	s := &MockSender{Sent: map[string][]string{}}
+	l.Set(s)
+
+	if err := l.Send(context.Background(), "topic", "key", "msg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Check(context.Background()); err != nil {
+		t.Errorf("was expecting the check to pass, got %v", err)
+	}
+	if len(s.Sent["topic"]) != 1 {
+		t.Errorf("was expecting the message to be sent by the producer, got %v", s.Sent)
+	}
+}
@@ -0,0 +1,78 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DeadLetter is the message published to a dead-letter topic when a message could not be handled.
+// It keeps the original value untouched along with where it came from and why it failed.
+type DeadLetter struct {
+	Topic     string    `json:"topic"`
+	Partition int32     `json:"partition"`
+	Offset    int64     `json:"offset"`
+	Key       string    `json:"key,omitempty"`
+	Value     []byte    `json:"value"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	Permanent bool      `json:"permanent"`
+	FailedAt  Timestamp `json:"failed_at"`
+	Metadata  Metadata  `json:"metadata"`
+}
+
+// DeadLetterQueue publishes dead letters to a topic
+type DeadLetterQueue struct {
+	sender Sender
+	topic  string
+}
+
+func NewDeadLetterQueue(sender Sender, topic string) *DeadLetterQueue {
+	return &DeadLetterQueue{sender: sender, topic: topic}
+}
+
+// Send publishes d to the dead-letter topic
+func (q *DeadLetterQueue) Send(ctx context.Context, d DeadLetter) error {
+	if d.FailedAt.IsZero() {
+		d.FailedAt = Timestamp{Time: time.Now()}
+	}
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	return q.sender.Send(ctx, q.topic, d.Key, string(b))
+}
+
+// Redriver is a MessageHandler reading dead letters and publishing their original value back
+// to the topic they failed on, or to target when it is set
+type Redriver struct {
+	sender Sender
+	target string
+}
+
+func NewRedriver(sender Sender, target string) *Redriver {
+	return &Redriver{sender: sender, target: target}
+}
+
+// HandleMessage re-publishes the original value of a dead letter
+func (r *Redriver) HandleMessage(ctx context.Context, message []byte) error {
+	d := DeadLetter{}
+	if err := json.Unmarshal(message, &d); err != nil {
+		return Permanent(err)
+	}
+
+	topic := d.Topic
+	if r.target != "" {
+		topic = r.target
+	}
+
+	log.Info().Str("traceID", d.Metadata.TraceID).Str("topic", topic).Int32("partition", d.Partition).Int64("offset", d.Offset).
+		Str("error", d.Error).Msg("re-driving dead letter")
+
+	// The message is published again with its original key and metadata
+	return r.sender.Send(ContextWithMetadata(ctx, d.Metadata), topic, d.Key, string(d.Value))
+}
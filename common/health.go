@@ -0,0 +1,227 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+)
+
+// Paths of the health endpoints
+const (
+	LivenessPath  = "/healthz"
+	ReadinessPath = "/readyz"
+)
+
+// Status of a check, and of the service as a whole
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// Defaults of NewHealth
+const (
+	DefaultHealthInterval = 5 * time.Second
+	DefaultHealthTimeout  = 2 * time.Second
+)
+
+// Check returns an error when a dependency of the service cannot be used
+type Check func(ctx context.Context) error
+
+// CheckResult is the outcome of a check, as returned by the readiness endpoint
+type CheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// DurationMs is how long the check took
+	DurationMs int64 `json:"duration_ms"`
+}
+
+// HealthReport is the body of the health endpoints
+type HealthReport struct {
+	Status    string        `json:"status"`
+	CheckedAt *time.Time    `json:"checked_at,omitempty"`
+	Checks    []CheckResult `json:"checks,omitempty"`
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Health runs the readiness checks of a service in the background and serves their last outcome,
+// so that probes neither wait for the dependencies nor hammer them. The service is not ready until
+// the checks ran once and all of them passed.
+type Health struct {
+	interval time.Duration
+	timeout  time.Duration
+
+	mu     sync.RWMutex
+	checks []namedCheck
+	report HealthReport
+}
+
+// NewHealth returns a Health running its checks every interval, each one bounded by timeout
+func NewHealth(interval, timeout time.Duration) *Health {
+	if interval <= 0 {
+		interval = DefaultHealthInterval
+	}
+	if timeout <= 0 {
+		timeout = DefaultHealthTimeout
+	}
+
+	return &Health{interval: interval, timeout: timeout, report: HealthReport{Status: StatusDown}}
+}
+
+// Register adds a readiness check, it must be called before Run
+func (h *Health) Register(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, namedCheck{name: name, check: check})
+}
+
+// Handle adds the liveness and readiness endpoints to r
+func (h *Health) Handle(r *mux.Router) {
+	r.HandleFunc(LivenessPath, h.Live).Methods(http.MethodGet)
+	r.HandleFunc(ReadinessPath, h.Ready).Methods(http.MethodGet)
+}
+
+// Run checks the dependencies straight away, then every interval until ctx is done
+func (h *Health) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		h.CheckNow(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckNow runs all the checks concurrently and caches their outcome
+func (h *Health) CheckNow(ctx context.Context) HealthReport {
+	h.mu.RLock()
+	checks := h.checks
+	h.mu.RUnlock()
+
+	results := make([]CheckResult, len(checks))
+	wg := sync.WaitGroup{}
+
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c namedCheck) {
+			defer wg.Done()
+			results[i] = h.run(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	now := time.Now().UTC()
+	report := HealthReport{Status: StatusUp, CheckedAt: &now, Checks: results}
+	for _, r := range results {
+		if r.Status != StatusUp {
+			report.Status = StatusDown
+		}
+	}
+
+	h.mu.Lock()
+	if report.Status != h.report.Status {
+		log.Info().Str("from", h.report.Status).Str("to", report.Status).Interface("checks", results).Msg("readiness changed")
+	}
+	h.report = report
+	h.mu.Unlock()
+
+	return report
+}
+
+// Report returns the outcome of the last checks
+func (h *Health) Report() HealthReport {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.report
+}
+
+// Live answers 200 as long as the service can serve requests, whatever the state of its dependencies
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, HealthReport{Status: StatusUp})
+}
+
+// Ready answers 200 when the last checks all passed and 503 otherwise, with the outcome of each check
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	report := h.Report()
+
+	status := http.StatusOK
+	if report.Status != StatusUp {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, report)
+}
+
+func (h *Health) run(ctx context.Context, c namedCheck) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := c.check(ctx)
+
+	result := CheckResult{Name: c.name, Status: StatusUp, DurationMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		result.Status, result.Error = StatusDown, err.Error()
+	}
+	return result
+}
+
+func writeHealth(w http.ResponseWriter, status int, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Error().Err(err).Msg("could not write health report")
+	}
+}
+
+// KafkaCheck passes when at least one of brokers accepts connections
+func KafkaCheck(brokers []string) Check {
+	return func(ctx context.Context) error {
+		err := errors.New("no broker")
+		for _, addr := range brokers {
+			var conn net.Conn
+			conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+			if err == nil {
+				return conn.Close()
+			}
+		}
+		return err
+	}
+}
+
+// HTTPCheck passes when url answers a GET with a 2xx status
+func HTTPCheck(client *http.Client, url string) Check {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return fmt.Errorf("%s answered %d", url, res.StatusCode)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,158 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestHealthReady(t *testing.T) {
+	tests := []struct {
+		name       string
+		checks     map[string]Check
+		run        bool
+		wantStatus int
+		wantErrors map[string]string
+	}{
+		{
+			name:       "not checked yet",
+			checks:     map[string]Check{"redis": func(context.Context) error { return nil }},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "all checks pass",
+			checks:     map[string]Check{"redis": func(context.Context) error { return nil }},
+			run:        true,
+			wantStatus: http.StatusOK,
+			wantErrors: map[string]string{"redis": ""},
+		},
+		{
+			name: "a check fails",
+			checks: map[string]Check{
+				"redis": func(context.Context) error { return nil },
+				"kafka": func(context.Context) error { return errors.New("unreachable") },
+			},
+			run:        true,
+			wantStatus: http.StatusServiceUnavailable,
+			wantErrors: map[string]string{"redis": "", "kafka": "unreachable"},
+		},
+		{
+			name: "a check times out",
+			checks: map[string]Check{"slow": func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			}},
+			run:        true,
+			wantStatus: http.StatusServiceUnavailable,
+			wantErrors: map[string]string{"slow": context.DeadlineExceeded.Error()},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHealth(time.Minute, 10*time.Millisecond)
+			for name, check := range tt.checks {
+				h.Register(name, check)
+			}
+			if tt.run {
+				h.CheckNow(context.Background())
+			}
+
+			r := mux.NewRouter()
+			h.Handle(r)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, ReadinessPath, nil))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("was expecting status %d, got %d", tt.wantStatus, w.Code)
+			}
+
+			report := HealthReport{}
+			if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(report.Checks) != len(tt.wantErrors) {
+				t.Fatalf("was expecting %d checks, got %v", len(tt.wantErrors), report.Checks)
+			}
+			for _, c := range report.Checks {
+				if c.Error != tt.wantErrors[c.Name] {
+					t.Errorf("was expecting check %s to fail with %q, got %q", c.Name, tt.wantErrors[c.Name], c.Error)
+				}
+			}
+		})
+	}
+}
+
+func TestHealthLive(t *testing.T) {
+	h := NewHealth(time.Minute, time.Second)
+	h.Register("kafka", func(context.Context) error { return errors.New("unreachable") })
+	h.CheckNow(context.Background())
+
+	r := mux.NewRouter()
+	h.Handle(r)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, LivenessPath, nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("was expecting a live service whatever its dependencies, got %d", w.Code)
+	}
+}
+
+func TestKafkaCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// A port nothing listens on anymore
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	tests := []struct {
+		name    string
+		brokers []string
+		wantErr bool
+	}{
+		{"broker reachable", []string{listener.Addr().String()}, false},
+		{"one broker of two reachable", []string{closedAddr, listener.Addr().String()}, false},
+		{"no broker reachable", []string{closedAddr}, true},
+		{"no broker", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := KafkaCheck(tt.brokers)(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("was expecting an error: %t, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestHTTPCheck(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != LivenessPath {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	if err := HTTPCheck(ts.Client(), ts.URL+LivenessPath)(context.Background()); err != nil {
+		t.Errorf("was expecting the check to pass, got %v", err)
+	}
+	if err := HTTPCheck(ts.Client(), ts.URL+"/unknown")(context.Background()); err == nil {
+		t.Error("was expecting a 404 to fail the check")
+	}
+}
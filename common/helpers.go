@@ -7,10 +7,18 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const TraceIDHeader = "X-Trace-Id"
 
+// SubjectHeader carries the caller authenticated by the gateway, it is never taken from the client
+const SubjectHeader = "X-Authenticated-Subject"
+
+// DeadlineHeader tells a service how many milliseconds are left before the caller gives up on the request
+const DeadlineHeader = "X-Request-Timeout-Ms"
+
 func GetIntVariableValue(r *http.Request, key string) (int, error) {
 	vars := mux.Vars(r)
 	strValue, ok := vars[key]
@@ -42,7 +50,18 @@ func GetIntParamValue(r *http.Request, key string) (int, error) {
 	return intValue, nil
 }
 
+// ExtractTraceIDFromReq returns the ID of the trace r is part of. Without a span, it falls back to the
+// traceparent or X-Trace-Id headers, and to a new ID for the requests that carry neither.
 func ExtractTraceIDFromReq(r *http.Request) (traceID string) {
+	if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+		return sc.TraceID().String()
+	}
+
+	ctx := propagation.TraceContext{}.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		return sc.TraceID().String()
+	}
+
 	traceID = r.Header.Get(TraceIDHeader)
 	if traceID == "" {
 		traceID = uuid.NewV4().String()
@@ -0,0 +1,175 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrProducerBufferFull is returned by KafkaAsyncProducer.Send when too many messages are
+// waiting for the broker to acknowledge them
+var ErrProducerBufferFull = errors.New("too many messages waiting to be delivered")
+
+// Delivery reports the outcome of an asynchronous publish
+type Delivery struct {
+	Topic     string
+	Key       string
+	Partition int32
+	Offset    int64
+	Metadata  Metadata
+	Latency   time.Duration
+	Err       error
+}
+
+// DeliveryCallback is called once for every message sent by a KafkaAsyncProducer. It is called
+// concurrently for successes and failures and must not block.
+type DeliveryCallback func(Delivery)
+
+// DeliveryStats counts the messages of a KafkaAsyncProducer
+type DeliveryStats struct {
+	InFlight  int64
+	Delivered int64
+	Failed    int64
+}
+
+// pending is attached to a message while it is in flight
+type pending struct {
+	metadata Metadata
+	sentAt   time.Time
+	// span is ended once the delivery is reported
+	span trace.Span
+}
+
+// KafkaAsyncProducer is a Sender that does not wait for the broker acknowledgement. Send returns
+// as soon as the message is buffered and the outcome is reported later to a DeliveryCallback.
+// At most maxInFlight messages can be waiting for an acknowledgement at any time.
+type KafkaAsyncProducer struct {
+	producer   sarama.AsyncProducer
+	inFlight   chan struct{}
+	onDelivery DeliveryCallback
+	wg         sync.WaitGroup
+
+	delivered int64
+	failed    int64
+}
+
+// NewKafkaAsyncSender starts reading the deliveries of producer, it must have been created with
+// Producer.Return.Successes and Producer.Return.Errors enabled
+func NewKafkaAsyncSender(producer sarama.AsyncProducer, maxInFlight int, onDelivery DeliveryCallback) *KafkaAsyncProducer {
+	k := &KafkaAsyncProducer{
+		producer:   producer,
+		inFlight:   make(chan struct{}, maxInFlight),
+		onDelivery: onDelivery,
+	}
+
+	k.wg.Add(2)
+
+	go func() {
+		defer k.wg.Done()
+		for msg := range producer.Successes() {
+			k.deliver(msg, nil)
+		}
+	}()
+
+	go func() {
+		defer k.wg.Done()
+		for err := range producer.Errors() {
+			k.deliver(err.Msg, err.Err)
+		}
+	}()
+
+	return k
+}
+
+// Send buffers msg to be published, it fails straight away when the buffer is full
+func (k *KafkaAsyncProducer) Send(ctx context.Context, topic, key, msg string) error {
+	select {
+	case k.inFlight <- struct{}{}:
+	default:
+		KafkaProduced.WithLabelValues(topic, ResultRejected).Inc()
+		return ErrProducerBufferFull
+	}
+
+	meta, _ := MetadataFromContext(ctx)
+	headers := meta.Headers()
+	span := startProducerSpan(ctx, topic, &headers)
+
+	kmsg := &sarama.ProducerMessage{
+		Topic:    topic,
+		Value:    sarama.StringEncoder(msg),
+		Headers:  headers,
+		Metadata: pending{metadata: meta, sentAt: time.Now(), span: span},
+	}
+
+	if key != "" {
+		kmsg.Key = sarama.StringEncoder(key)
+	}
+
+	select {
+	case k.producer.Input() <- kmsg:
+		return nil
+	case <-ctx.Done():
+		<-k.inFlight
+		endSpan(span, ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// Stats returns the number of messages in flight, delivered and failed so far
+func (k *KafkaAsyncProducer) Stats() DeliveryStats {
+	return DeliveryStats{
+		InFlight:  int64(len(k.inFlight)),
+		Delivered: atomic.LoadInt64(&k.delivered),
+		Failed:    atomic.LoadInt64(&k.failed),
+	}
+}
+
+// Close flushes the buffered messages and waits for all their deliveries to be reported
+func (k *KafkaAsyncProducer) Close() {
+	k.producer.AsyncClose()
+	k.wg.Wait()
+}
+
+func (k *KafkaAsyncProducer) deliver(msg *sarama.ProducerMessage, err error) {
+	<-k.inFlight
+
+	if p, ok := msg.Metadata.(pending); ok {
+		endSpan(p.span, err)
+	}
+
+	KafkaProduced.WithLabelValues(msg.Topic, resultOf(err)).Inc()
+	if err != nil {
+		atomic.AddInt64(&k.failed, 1)
+	} else {
+		atomic.AddInt64(&k.delivered, 1)
+	}
+
+	if k.onDelivery == nil {
+		return
+	}
+
+	d := Delivery{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Err:       err,
+	}
+
+	if msg.Key != nil {
+		if key, encodeErr := msg.Key.Encode(); encodeErr == nil {
+			d.Key = string(key)
+		}
+	}
+
+	if p, ok := msg.Metadata.(pending); ok {
+		d.Metadata = p.metadata
+		d.Latency = time.Since(p.sentAt)
+	}
+
+	k.onDelivery(d)
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+// MockAsyncProducer buffers one input message and lets the test decide its outcome
+type MockAsyncProducer struct {
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+}
+
+func NewMockAsyncProducer() *MockAsyncProducer {
+	return &MockAsyncProducer{
+		input:     make(chan *sarama.ProducerMessage, 1),
+		successes: make(chan *sarama.ProducerMessage),
+		errors:    make(chan *sarama.ProducerError),
+	}
+}
+
+func (m *MockAsyncProducer) AsyncClose() {
+	close(m.successes)
+	close(m.errors)
+}
+
+func (m *MockAsyncProducer) Close() error {
+	m.AsyncClose()
+	return nil
+}
+
+func (m *MockAsyncProducer) Input() chan<- *sarama.ProducerMessage     { return m.input }
+func (m *MockAsyncProducer) Successes() <-chan *sarama.ProducerMessage { return m.successes }
+func (m *MockAsyncProducer) Errors() <-chan *sarama.ProducerError      { return m.errors }
+
+func TestKafkaAsyncProducer(t *testing.T) {
+	mock := NewMockAsyncProducer()
+	deliveries := make(chan Delivery, 2)
+
+	p := NewKafkaAsyncSender(mock, 1, func(d Delivery) {
+		deliveries <- d
+	})
+
+	ctx := ContextWithMetadata(context.Background(), Metadata{TraceID: "trace"})
+
+	if err := p.Send(ctx, "locations", "42", "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The only slot is taken until the broker acknowledges the first message
+	if err := p.Send(ctx, "locations", "42", "second"); err != ErrProducerBufferFull {
+		t.Errorf("was expecting ErrProducerBufferFull, got %v", err)
+	}
+
+	mock.successes <- <-mock.input
+	delivered := <-deliveries
+
+	if err := p.Send(ctx, "locations", "43", "third"); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.errors <- &sarama.ProducerError{Msg: <-mock.input, Err: errors.New("broker is down")}
+	failed := <-deliveries
+
+	p.Close()
+
+	if delivered.Err != nil || delivered.Key != "42" || delivered.Metadata.TraceID != "trace" {
+		t.Errorf("unexpected successful delivery %+v", delivered)
+	}
+
+	if failed.Err == nil || failed.Key != "43" {
+		t.Errorf("unexpected failed delivery %+v", failed)
+	}
+
+	stats := p.Stats()
+	if stats.InFlight != 0 || stats.Delivered != 1 || stats.Failed != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
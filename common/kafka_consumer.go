@@ -1,63 +1,85 @@
 package common
 
 import (
-	"os"
-	"os/signal"
+	"context"
 
 	"github.com/Shopify/sarama"
 	"github.com/rs/zerolog/log"
 )
 
+// Consumer consumes a topic until ctx is cancelled
 type Consumer interface {
-	Receive(topic string) error
+	Receive(ctx context.Context, topic string) error
 }
 
 type KafkaConsumer struct {
-	consumer sarama.Consumer
-	handler  MessageHandler
+	consumer  sarama.Consumer
+	processor *messageProcessor
 }
 
+// MessageHandler handles a consumed message, ctx carries the Metadata read from the record headers
 type MessageHandler interface {
-	HandleMessage(message []byte) error
+	HandleMessage(ctx context.Context, message []byte) error
 }
 
-func NewKafkaConsumer(consumer sarama.Consumer, handler MessageHandler) *KafkaConsumer {
-	return &KafkaConsumer{consumer: consumer, handler: handler}
+func NewKafkaConsumer(consumer sarama.Consumer, handler MessageHandler, opts ...ConsumerOption) *KafkaConsumer {
+	return &KafkaConsumer{consumer: consumer, processor: newMessageProcessor(handler, opts)}
 }
 
-func (k KafkaConsumer) Receive(topic string) error {
+func (k KafkaConsumer) Receive(ctx context.Context, topic string) error {
 	defer func() {
 		if err := k.consumer.Close(); err != nil {
 			log.Error().Err(err).Msg("error closing consumer")
 		}
 	}()
 
-	consumer, err := k.consumer.ConsumePartition(topic, 0, sarama.OffsetOldest)
+	partitions, err := k.consumer.Partitions(topic)
 	if err != nil {
 		return err
 	}
 
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt)
-	doneCh := make(chan struct{})
-
-	go func() {
-		for {
-			select {
-			case err := <-consumer.Errors():
-				log.Error().Err(err).Msg("consumer error")
-			case msg := <-consumer.Messages():
-				err := k.handler.HandleMessage(msg.Value)
-				if err != nil {
-					log.Error().Err(err).Msg("error receiving msg")
+	messages := make(chan *sarama.ConsumerMessage)
+	errs := make(chan *sarama.ConsumerError)
+
+	// Without a consumer group there is no partition assignment, so every partition
+	// of the topic is consumed by this process
+	for _, partition := range partitions {
+		pc, err := k.consumer.ConsumePartition(topic, partition, sarama.OffsetOldest)
+		if err != nil {
+			return err
+		}
+		defer pc.AsyncClose()
+
+		go func(pc sarama.PartitionConsumer) {
+			for msg := range pc.Messages() {
+				select {
+				case messages <- msg:
+				case <-ctx.Done():
+					return
 				}
-			case <-signals:
-				log.Info().Msg("Interrupt is detected")
-				doneCh <- struct{}{}
+				ObserveLag(msg.Topic, msg.Partition, pc.HighWaterMarkOffset(), msg.Offset)
 			}
-		}
-	}()
+		}(pc)
 
-	<-doneCh
-	return nil
+		go func(pc sarama.PartitionConsumer) {
+			for err := range pc.Errors() {
+				select {
+				case errs <- err:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(pc)
+	}
+
+	for {
+		select {
+		case err := <-errs:
+			log.Error().Err(err).Msg("consumer error")
+		case msg := <-messages:
+			k.processor.process(ctx, msg)
+		case <-ctx.Done():
+			return nil
+		}
+	}
 }
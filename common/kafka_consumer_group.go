@@ -0,0 +1,146 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// OffsetOldest starts a new consumer group at the oldest message still available on the topic
+	OffsetOldest = "oldest"
+	// OffsetNewest starts a new consumer group at the next message published to the topic
+	OffsetNewest = "newest"
+)
+
+// ConsumerGroupConfig holds the settings needed to join a consumer group
+type ConsumerGroupConfig struct {
+	Brokers []string
+	GroupID string
+	// InitialOffset is only used when the group has no committed offset for a partition,
+	// it is either OffsetOldest or OffsetNewest
+	InitialOffset string
+}
+
+// KafkaGroupConsumer consumes all the partitions of a topic as a member of a consumer group.
+// Partitions are rebalanced between the members of the group and offsets are committed
+// once a message has been handled so that a restarted consumer resumes where it stopped.
+type KafkaGroupConsumer struct {
+	group     sarama.ConsumerGroup
+	processor *messageProcessor
+}
+
+// NewSaramaGroupConfig returns a sarama config suitable for a consumer group starting at initialOffset
+func NewSaramaGroupConfig(initialOffset string) (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_3_0_0
+	config.Consumer.Return.Errors = true
+	config.Consumer.Offsets.AutoCommit.Enable = true
+	config.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategyRange
+
+	switch strings.ToLower(initialOffset) {
+	case OffsetOldest, "":
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	case OffsetNewest:
+		config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	default:
+		return nil, fmt.Errorf("unknown initial offset %q, expected %q or %q", initialOffset, OffsetOldest, OffsetNewest)
+	}
+
+	return config, nil
+}
+
+// NewKafkaGroupConsumerFromConfig connects to the brokers and joins the consumer group described by c
+func NewKafkaGroupConsumerFromConfig(c ConsumerGroupConfig, handler MessageHandler, opts ...ConsumerOption) (*KafkaGroupConsumer, error) {
+	config, err := NewSaramaGroupConfig(c.InitialOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	group, err := sarama.NewConsumerGroup(c.Brokers, c.GroupID, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKafkaGroupConsumer(group, handler, opts...), nil
+}
+
+func NewKafkaGroupConsumer(group sarama.ConsumerGroup, handler MessageHandler, opts ...ConsumerOption) *KafkaGroupConsumer {
+	return &KafkaGroupConsumer{group: group, processor: newMessageProcessor(handler, opts)}
+}
+
+// Receive joins the group and consumes topic until ctx is cancelled, joining it again with a backoff
+// when the brokers cannot be reached. The messages being handled are finished and committed before it returns.
+func (k *KafkaGroupConsumer) Receive(ctx context.Context, topic string) error {
+	defer func() {
+		if err := k.group.Close(); err != nil {
+			log.Error().Err(err).Msg("error closing consumer group")
+		}
+	}()
+
+	go func() {
+		for err := range k.group.Errors() {
+			log.Error().Err(err).Msg("consumer group error")
+		}
+	}()
+
+	failures := 0
+	for {
+		// Consume blocks for the duration of a session, it returns when the group
+		// rebalances and has to be called again to get the new partition assignment
+		err := k.group.Consume(ctx, []string{topic}, k)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == sarama.ErrClosedConsumerGroup {
+			return err
+		}
+
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		// The brokers are unreachable or restarting, the group is joined again once they are back
+		failures++
+		backoff := ConnectPolicy.Backoff(failures)
+		log.Error().Err(err).Str("topic", topic).Dur("backoff", backoff).Msg("could not join consumer group, retrying")
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// Setup is called at the beginning of a session, once partitions have been assigned
+func (k *KafkaGroupConsumer) Setup(session sarama.ConsumerGroupSession) error {
+	log.Info().Interface("claims", session.Claims()).Int32("generation", session.GenerationID()).
+		Msg("consumer group session started")
+	return nil
+}
+
+// Cleanup is called at the end of a session, before the last offsets are committed
+func (k *KafkaGroupConsumer) Cleanup(session sarama.ConsumerGroupSession) error {
+	log.Info().Int32("generation", session.GenerationID()).Msg("consumer group session ended")
+	return nil
+}
+
+// ConsumeClaim handles the messages of one partition and marks them as consumed
+func (k *KafkaGroupConsumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		// The session is cancelled on rebalance, an unfinished message is left
+		// uncommitted so that the next owner of the partition handles it
+		if !k.processor.process(session.Context(), msg) {
+			return nil
+		}
+		session.MarkMessage(msg, "")
+		ObserveLag(msg.Topic, msg.Partition, claim.HighWaterMarkOffset(), msg.Offset)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/go-test/deep"
+)
+
+// recordingHandler records the messages it handles, it fails all of them when err is set
+type recordingHandler struct {
+	mu      sync.Mutex
+	handled map[string]bool
+	err     error
+}
+
+func (h *recordingHandler) HandleMessage(ctx context.Context, message []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.err != nil {
+		return h.err
+	}
+	h.handled[string(message)] = true
+	return nil
+}
+
+func (h *recordingHandler) wasHandled(message []byte) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.handled[string(message)]
+}
+
+// fakeSession is a sarama.ConsumerGroupSession recording the messages marked by partition, and whether
+// they were handled by the time they were marked
+type fakeSession struct {
+	ctx       context.Context
+	handler   *recordingHandler
+	mu        sync.Mutex
+	marked    map[int32][]string
+	unhandled []string
+	// done is closed once want messages are marked
+	want int
+	done chan struct{}
+}
+
+func newFakeSession(ctx context.Context, handler *recordingHandler, want int) *fakeSession {
+	return &fakeSession{ctx: ctx, handler: handler, marked: map[int32][]string{}, want: want, done: make(chan struct{})}
+}
+
+func (s *fakeSession) Claims() map[string][]int32               { return nil }
+func (s *fakeSession) MemberID() string                         { return "member" }
+func (s *fakeSession) GenerationID() int32                      { return 1 }
+func (s *fakeSession) MarkOffset(string, int32, int64, string)  {}
+func (s *fakeSession) Commit()                                  {}
+func (s *fakeSession) ResetOffset(string, int32, int64, string) {}
+func (s *fakeSession) Context() context.Context                 { return s.ctx }
+
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.handler.wasHandled(msg.Value) {
+		s.unhandled = append(s.unhandled, string(msg.Value))
+	}
+	s.marked[msg.Partition] = append(s.marked[msg.Partition], string(msg.Value))
+
+	if s.want--; s.want == 0 {
+		close(s.done)
+	}
+}
+
+// fakeClaim is a sarama.ConsumerGroupClaim delivering the given messages
+type fakeClaim struct {
+	partition int32
+	messages  chan *sarama.ConsumerMessage
+}
+
+func newFakeClaim(topic string, partition int32, values ...string) *fakeClaim {
+	c := &fakeClaim{partition: partition, messages: make(chan *sarama.ConsumerMessage, len(values))}
+	for i, v := range values {
+		c.messages <- &sarama.ConsumerMessage{Topic: topic, Partition: partition, Offset: int64(i), Value: []byte(v)}
+	}
+	return c
+}
+
+func (c *fakeClaim) Topic() string                            { return "topic" }
+func (c *fakeClaim) Partition() int32                         { return c.partition }
+func (c *fakeClaim) InitialOffset() int64                     { return 0 }
+func (c *fakeClaim) HighWaterMarkOffset() int64               { return int64(len(c.messages)) }
+func (c *fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+// partitionedGroup is a sarama.ConsumerGroup running one session in which every partition of claims
+// is consumed in its own goroutine, like sarama does, until ctx is done
+type partitionedGroup struct {
+	session *fakeSession
+	claims  []*fakeClaim
+	closed  bool
+}
+
+func (g *partitionedGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	g.session.ctx = ctx
+	if err := handler.Setup(g.session); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range g.claims {
+		wg.Add(1)
+		go func(c *fakeClaim) {
+			defer wg.Done()
+			handler.ConsumeClaim(g.session, c)
+		}(c)
+	}
+
+	<-ctx.Done()
+	for _, c := range g.claims {
+		close(c.messages)
+	}
+	wg.Wait()
+
+	return handler.Cleanup(g.session)
+}
+
+func (g *partitionedGroup) Errors() <-chan error {
+	return make(chan error)
+}
+
+func (g *partitionedGroup) Close() error {
+	g.closed = true
+	return nil
+}
+
+// flakyGroup is a sarama.ConsumerGroup whose sessions fail with errs in order, then block until ctx is done
+type flakyGroup struct {
+	errs     []error
+	sessions int
+	errors   chan error
+}
+
+func (f *flakyGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	f.sessions++
+	if f.sessions <= len(f.errs) {
+		return f.errs[f.sessions-1]
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func (f *flakyGroup) Errors() <-chan error {
+	return f.errors
+}
+
+func (f *flakyGroup) Close() error {
+	close(f.errors)
+	return nil
+}
+
+func TestKafkaGroupConsumerReceive(t *testing.T) {
+	tests := []struct {
+		name         string
+		errs         []error
+		wantErr      error
+		wantSessions int
+	}{
+		{"broker restarting", []error{sarama.ErrOutOfBrokers}, nil, 2},
+		{"group closed", []error{sarama.ErrClosedConsumerGroup}, sarama.ErrClosedConsumerGroup, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group := &flakyGroup{errs: tt.errs, errors: make(chan error)}
+			consumer := NewKafkaGroupConsumer(group, &MockHandler{})
+
+			// Long enough for one retry of ConnectPolicy
+			ctx, cancel := context.WithTimeout(context.Background(), 2*ConnectPolicy.InitialBackoff)
+			defer cancel()
+
+			err := consumer.Receive(ctx, "topic")
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("was expecting %v, got %v", tt.wantErr, err)
+			}
+			if group.sessions != tt.wantSessions {
+				t.Errorf("was expecting %d sessions, got %d", tt.wantSessions, group.sessions)
+			}
+		})
+	}
+}
+
+func TestKafkaGroupConsumerSharesPartitions(t *testing.T) {
+	handler := &recordingHandler{handled: map[string]bool{}}
+	group := &partitionedGroup{
+		session: newFakeSession(nil, handler, 5),
+		claims: []*fakeClaim{
+			newFakeClaim("topic", 0, "a1", "a2", "a3"),
+			newFakeClaim("topic", 1, "b1", "b2"),
+		},
+	}
+	consumer := NewKafkaGroupConsumer(group, handler)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stopped once all the messages are committed
+	go func() {
+		select {
+		case <-group.session.done:
+		case <-time.After(time.Second):
+		}
+		cancel()
+	}()
+
+	if err := consumer.Receive(ctx, "topic"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[int32][]string{0: {"a1", "a2", "a3"}, 1: {"b1", "b2"}}
+	if diff := deep.Equal(group.session.marked, want); diff != nil {
+		t.Error(diff)
+	}
+	if len(group.session.unhandled) != 0 {
+		t.Errorf("was expecting messages to be committed once handled, got %v committed first", group.session.unhandled)
+	}
+	if !group.closed {
+		t.Error("was expecting the group to be closed once stopped")
+	}
+}
+
+func TestKafkaGroupConsumerLeavesUnfinishedMessages(t *testing.T) {
+	handler := &recordingHandler{handled: map[string]bool{}, err: errors.New("database down")}
+	consumer := NewKafkaGroupConsumer(&partitionedGroup{}, handler, WithRetry(RetryPolicy{MaxRetries: 5, InitialBackoff: time.Hour}))
+
+	// The session is cancelled on rebalance while the first message waits to be retried
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	session := newFakeSession(ctx, handler, -1)
+
+	if err := consumer.ConsumeClaim(session, newFakeClaim("topic", 0, "a1", "a2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(session.marked) != 0 {
+		t.Errorf("was expecting no message to be committed, got %v", session.marked)
+	}
+}
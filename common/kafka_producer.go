@@ -1,13 +1,17 @@
 package common
 
 import (
+	"context"
 	"log"
 
 	"github.com/Shopify/sarama"
 )
 
+// Sender publishes msg to topic, the Metadata carried by ctx is sent along with it.
+// Messages sharing the same non empty key go to the same partition and keep their order,
+// messages without a key are spread across partitions.
 type Sender interface {
-	Send(topic, msg string) error
+	Send(ctx context.Context, topic, key, msg string) error
 }
 
 type KafkaProducer struct {
@@ -18,17 +22,42 @@ func NewKafkaSender(producer sarama.SyncProducer) *KafkaProducer {
 	return &KafkaProducer{producer: producer}
 }
 
-func (k *KafkaProducer) Send(topic, msg string) error {
+// Send waits for the broker to acknowledge the message, or for ctx to be done
+func (k *KafkaProducer) Send(ctx context.Context, topic, key, msg string) error {
 	kmsg := &sarama.ProducerMessage{
 		Topic: topic,
 		Value: sarama.StringEncoder(msg),
 	}
 
-	partition, offset, err := k.producer.SendMessage(kmsg)
-	if err != nil {
-		return err
+	// The default partitioner hashes the key to pick the partition
+	if key != "" {
+		kmsg.Key = sarama.StringEncoder(key)
+	}
+
+	// Record headers need a producer configured with Version >= sarama.V0_11_0_0
+	if m, ok := MetadataFromContext(ctx); ok {
+		kmsg.Headers = m.Headers()
 	}
 
-	log.Printf("Message is stored in topic(%s)/partition(%d)/offset(%d)\n", topic, partition, offset)
-	return nil
+	span := startProducerSpan(ctx, topic, &kmsg.Headers)
+
+	// SendMessage cannot be cancelled, the caller stops waiting when ctx is done but the producer
+	// keeps retrying and may still deliver the message
+	done := make(chan error, 1)
+	go func() {
+		partition, offset, err := k.producer.SendMessage(kmsg)
+		KafkaProduced.WithLabelValues(topic, resultOf(err)).Inc()
+		endSpan(span, err)
+		if err == nil {
+			log.Printf("Message is stored in topic(%s)/partition(%d)/offset(%d)\n", topic, partition, offset)
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -0,0 +1,60 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// MockSyncProducer answers every message with err once release is closed
+type MockSyncProducer struct {
+	release chan struct{}
+	err     error
+}
+
+func (m *MockSyncProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	<-m.release
+	return 0, 0, m.err
+}
+
+func (m *MockSyncProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	<-m.release
+	return m.err
+}
+
+func (m *MockSyncProducer) Close() error {
+	return nil
+}
+
+func TestKafkaProducerSend(t *testing.T) {
+	released := make(chan struct{})
+	close(released)
+
+	tests := []struct {
+		name    string
+		release chan struct{}
+		err     error
+		timeout time.Duration
+		want    error
+	}{
+		{name: "delivered", release: released, timeout: time.Second},
+		{name: "failed", release: released, err: sarama.ErrOutOfBrokers, timeout: time.Second, want: sarama.ErrOutOfBrokers},
+		{name: "broker does not answer in time", release: make(chan struct{}), timeout: 10 * time.Millisecond, want: context.DeadlineExceeded},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k := NewKafkaSender(&MockSyncProducer{release: test.release, err: test.err})
+
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
+
+			if err := k.Send(ctx, "locations", "6", "{}"); !errors.Is(err, test.want) {
+				t.Errorf("got error %v, want %v", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultShutdownTimeout leaves some room before kubernetes kills a pod, 30 seconds after SIGTERM
+const DefaultShutdownTimeout = 25 * time.Second
+
+// ErrShutdownTimeout is returned by Lifecycle.Run when the components did not stop in time
+var ErrShutdownTimeout = errors.New("shutdown timed out")
+
+// component is started by Lifecycle.Run and stopped on shutdown, either of run and stop can be nil
+type component struct {
+	name string
+	run  func(ctx context.Context) error
+	stop func(ctx context.Context) error
+}
+
+// Lifecycle runs the components of a service until SIGINT or SIGTERM is received or one of them stops,
+// then stops them one after the other in the reverse order they were added, within a deadline. Adding
+// the producers, then the consumers, then the HTTP servers stops accepting requests first, then drains
+// the messages being handled, and flushes the producers last.
+type Lifecycle struct {
+	timeout    time.Duration
+	components []component
+}
+
+func NewLifecycle(shutdownTimeout time.Duration) *Lifecycle {
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = DefaultShutdownTimeout
+	}
+	return &Lifecycle{timeout: shutdownTimeout}
+}
+
+// Go adds a component running until its ctx is cancelled, stopping it waits for run to return
+func (l *Lifecycle) Go(name string, run func(ctx context.Context) error) {
+	l.components = append(l.components, component{name: name, run: run})
+}
+
+// Server adds an HTTP server, stopping it waits for the requests in flight to complete
+func (l *Lifecycle) Server(name string, srv *http.Server) {
+	l.components = append(l.components, component{
+		name: name,
+		run: func(ctx context.Context) error {
+			log.Info().Str("component", name).Str("addr", srv.Addr).Msg("listening")
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		},
+		stop: srv.Shutdown,
+	})
+}
+
+// OnStop adds a function called on shutdown once the components added after it are stopped,
+// e.g to flush a producer or close a client
+func (l *Lifecycle) OnStop(name string, stop func(ctx context.Context) error) {
+	l.components = append(l.components, component{name: name, stop: stop})
+}
+
+// Run starts the components and blocks until they are all stopped. It returns the error of the
+// component that stopped the service, or ErrShutdownTimeout when they do not stop in time.
+func (l *Lifecycle) Run(ctx context.Context) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	type exit struct {
+		index int
+		err   error
+	}
+
+	exits := make(chan exit, len(l.components))
+	done := make([]chan struct{}, len(l.components))
+	cancels := make([]context.CancelFunc, len(l.components))
+
+	for i, c := range l.components {
+		if c.run == nil {
+			continue
+		}
+
+		// Components are only cancelled one after the other on shutdown, not when ctx is
+		runCtx, cancel := context.WithCancel(context.Background())
+		cancels[i], done[i] = cancel, make(chan struct{})
+
+		go func(i int, c component) {
+			defer close(done[i])
+			exits <- exit{index: i, err: c.run(runCtx)}
+		}(i, c)
+	}
+
+	var cause error
+	select {
+	case s := <-signals:
+		log.Info().Str("signal", s.String()).Msg("shutting down")
+	case <-ctx.Done():
+		log.Info().Msg("shutting down")
+	case e := <-exits:
+		cause = e.err
+		log.Error().Err(e.err).Str("component", l.components[e.index].name).Msg("component stopped, shutting down")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for i := len(l.components) - 1; i >= 0; i-- {
+			l.stop(shutdownCtx, i, cancels[i], done[i])
+		}
+	}()
+
+	select {
+	case <-stopped:
+		log.Info().Msg("shutdown complete")
+		return cause
+	case <-shutdownCtx.Done():
+		log.Error().Dur("timeout", l.timeout).Msg("shutdown timed out")
+		return ErrShutdownTimeout
+	}
+}
+
+// stop stops the component at index i and waits for it to return
+func (l *Lifecycle) stop(ctx context.Context, i int, cancel context.CancelFunc, done chan struct{}) {
+	c := l.components[i]
+
+	if c.stop != nil {
+		if err := c.stop(ctx); err != nil {
+			log.Error().Err(err).Str("component", c.name).Msg("could not stop component")
+		}
+	}
+
+	if cancel != nil {
+		cancel()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	log.Info().Str("component", c.name).Msg("stopped")
+}
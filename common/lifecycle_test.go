@@ -0,0 +1,124 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+// stopRecorder remembers the order the components of a test are stopped in
+type stopRecorder struct {
+	mu      sync.Mutex
+	stopped []string
+}
+
+func (s *stopRecorder) record(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = append(s.stopped, name)
+}
+
+// run returns a component running until its ctx is cancelled, started is closed once it runs
+func (s *stopRecorder) run(name string, started chan struct{}) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if started != nil {
+			close(started)
+		}
+		<-ctx.Done()
+		s.record(name)
+		return nil
+	}
+}
+
+func (s *stopRecorder) stop(name string) func(ctx context.Context) error {
+	return func(context.Context) error {
+		s.record(name)
+		return nil
+	}
+}
+
+func TestLifecycleStopsInReverseOrder(t *testing.T) {
+	s := &stopRecorder{}
+	started := make(chan struct{})
+
+	l := NewLifecycle(time.Second)
+	l.OnStop("producer", s.stop("producer"))
+	l.Go("consumer", s.run("consumer", nil))
+	l.Go("server", s.run("server", started))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	if err := l.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := deep.Equal(s.stopped, []string{"server", "consumer", "producer"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestLifecycleStopsOnSignal(t *testing.T) {
+	s := &stopRecorder{}
+	started := make(chan struct{})
+
+	l := NewLifecycle(time.Second)
+	l.Go("consumer", s.run("consumer", started))
+
+	go func() {
+		<-started
+		syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	}()
+
+	if err := l.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := deep.Equal(s.stopped, []string{"consumer"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestLifecycleStopsWhenAComponentFails(t *testing.T) {
+	s := &stopRecorder{}
+	failure := errors.New("consumer group closed")
+
+	l := NewLifecycle(time.Second)
+	l.OnStop("producer", s.stop("producer"))
+	l.Go("consumer", func(context.Context) error { return failure })
+	l.Go("server", s.run("server", nil))
+
+	if err := l.Run(context.Background()); err != failure {
+		t.Errorf("was expecting the error of the consumer, got %v", err)
+	}
+
+	if diff := deep.Equal(s.stopped, []string{"server", "producer"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestLifecycleShutdownTimeout(t *testing.T) {
+	stuck := make(chan struct{})
+	defer close(stuck)
+
+	l := NewLifecycle(50 * time.Millisecond)
+	l.Go("stuck", func(context.Context) error {
+		<-stuck
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := l.Run(ctx); err != ErrShutdownTimeout {
+		t.Errorf("was expecting %v, got %v", ErrShutdownTimeout, err)
+	}
+}
@@ -0,0 +1,130 @@
+package common
+
+import (
+	"context"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rs/zerolog/log"
+)
+
+// ConsumerOption customises what a consumer does with the messages its handler failed on
+type ConsumerOption func(*messageProcessor)
+
+// WithRetry handles a failing message again according to policy before giving up on it
+func WithRetry(policy RetryPolicy) ConsumerOption {
+	return func(p *messageProcessor) {
+		p.retry = policy
+	}
+}
+
+// WithDeadLetterQueue publishes the messages that could not be handled to queue
+// instead of dropping them
+func WithDeadLetterQueue(queue *DeadLetterQueue) ConsumerOption {
+	return func(p *messageProcessor) {
+		p.deadLetter = queue
+	}
+}
+
+// messageProcessor is shared by the consumers to call the handler, retry and dead-letter messages
+type messageProcessor struct {
+	handler    MessageHandler
+	retry      RetryPolicy
+	deadLetter *DeadLetterQueue
+}
+
+// detachedContext keeps the values of its parent, e.g its span, but is never cancelled
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (d detachedContext) Value(key interface{}) interface{} {
+	return d.parent.Value(key)
+}
+
+func newMessageProcessor(handler MessageHandler, opts []ConsumerOption) *messageProcessor {
+	p := &messageProcessor{handler: handler, retry: NoRetry}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// process handles msg until it succeeds, fails permanently or runs out of retries, in which
+// case it is sent to the dead-letter queue. It returns false if ctx is cancelled while waiting
+// to retry: msg has not been dealt with and must not be committed.
+func (p *messageProcessor) process(ctx context.Context, msg *sarama.ConsumerMessage) bool {
+	attempts := 0
+
+	ctx, span := startConsumerSpan(ctx, msg)
+
+	// A message being handled is finished on shutdown, only the wait before a retry is cut short
+	meta := MetadataFromHeaders(msg.Headers)
+	handlerCtx := ContextWithMetadata(detachedContext{parent: ctx}, meta)
+
+	var err error
+	for {
+		attempts++
+
+		err = p.handler.HandleMessage(handlerCtx, msg.Value)
+		if err == nil {
+			KafkaConsumed.WithLabelValues(msg.Topic, ResultOK).Inc()
+			span.End()
+			return true
+		}
+
+		if IsPermanent(err) || attempts > p.retry.MaxRetries {
+			break
+		}
+
+		backoff := p.retry.Backoff(attempts)
+		log.Warn().Err(err).Str("traceID", meta.TraceID).Str("topic", msg.Topic).Int32("partition", msg.Partition).Int64("offset", msg.Offset).
+			Int("attempt", attempts).Dur("backoff", backoff).Msg("error receiving msg, retrying")
+
+		select {
+		case <-ctx.Done():
+			endSpan(span, ctx.Err())
+			return false
+		case <-time.After(backoff):
+		}
+	}
+
+	// The dead letter is published as part of the span of the message
+	defer endSpan(span, err)
+
+	permanent := IsPermanent(err)
+	log.Error().Err(err).Str("traceID", meta.TraceID).Str("topic", msg.Topic).Int32("partition", msg.Partition).Int64("offset", msg.Offset).
+		Int("attempts", attempts).Bool("permanent", permanent).Msg("error receiving msg")
+
+	if p.deadLetter == nil {
+		KafkaConsumed.WithLabelValues(msg.Topic, ResultError).Inc()
+		return true
+	}
+
+	// The dead letter keeps the headers of the original message so that it can be traced
+	err = p.deadLetter.Send(handlerCtx, DeadLetter{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       string(msg.Key),
+		Value:     msg.Value,
+		Error:     err.Error(),
+		Attempts:  attempts,
+		Permanent: permanent,
+		Metadata:  meta,
+	})
+	if err != nil {
+		log.Error().Err(err).Str("traceID", meta.TraceID).Str("topic", msg.Topic).Int32("partition", msg.Partition).Int64("offset", msg.Offset).
+			Msg("could not send message to dead-letter queue, message is lost")
+		KafkaConsumed.WithLabelValues(msg.Topic, ResultError).Inc()
+		return true
+	}
+
+	KafkaConsumed.WithLabelValues(msg.Topic, ResultDeadLetter).Inc()
+
+	return true
+}
@@ -0,0 +1,170 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+type MockSender struct {
+	Sent map[string][]string
+}
+
+func (m *MockSender) Send(ctx context.Context, topic, key, msg string) error {
+	m.Sent[topic] = append(m.Sent[topic], msg)
+	return nil
+}
+
+type MockHandler struct {
+	calls int
+	errs  []error
+}
+
+// HandleMessage returns the errors in order then succeeds
+func (m *MockHandler) HandleMessage(ctx context.Context, message []byte) error {
+	m.calls++
+	if m.calls <= len(m.errs) {
+		return m.errs[m.calls-1]
+	}
+	return nil
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	tests := []struct {
+		retry    int
+		expected time.Duration
+	}{
+		{retry: 0, expected: 0},
+		{retry: 1, expected: 100 * time.Millisecond},
+		{retry: 2, expected: 200 * time.Millisecond},
+		{retry: 4, expected: 800 * time.Millisecond},
+		{retry: 5, expected: time.Second},
+	}
+
+	for _, test := range tests {
+		if res := p.Backoff(test.retry); res != test.expected {
+			t.Errorf("backoff for retry %d: got %s want %s", test.retry, res, test.expected)
+		}
+	}
+}
+
+func TestMessageProcessor(t *testing.T) {
+	failure := errors.New("database is down")
+
+	tests := []struct {
+		name            string
+		errs            []error
+		maxRetries      int
+		expectedCalls   int
+		expectDead      bool
+		expectPermanent bool
+	}{
+		{
+			name:          "succeeds after retries",
+			errs:          []error{failure, failure},
+			maxRetries:    3,
+			expectedCalls: 3,
+		},
+		{
+			name:          "runs out of retries",
+			errs:          []error{failure, failure, failure},
+			maxRetries:    2,
+			expectedCalls: 3,
+			expectDead:    true,
+		},
+		{
+			name:            "permanent error is not retried",
+			errs:            []error{Permanent(failure)},
+			maxRetries:      3,
+			expectedCalls:   1,
+			expectDead:      true,
+			expectPermanent: true,
+		},
+		{
+			name:            "unparseable message is not retried",
+			errs:            []error{&json.SyntaxError{}},
+			maxRetries:      3,
+			expectedCalls:   1,
+			expectDead:      true,
+			expectPermanent: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := &MockHandler{errs: test.errs}
+			sender := &MockSender{Sent: map[string][]string{}}
+
+			p := newMessageProcessor(handler, []ConsumerOption{
+				WithRetry(RetryPolicy{MaxRetries: test.maxRetries, InitialBackoff: time.Millisecond}),
+				WithDeadLetterQueue(NewDeadLetterQueue(sender, "dlq")),
+			})
+
+			msg := &sarama.ConsumerMessage{Topic: "locations", Partition: 1, Offset: 42, Value: []byte(`{}`)}
+			if !p.process(context.Background(), msg) {
+				t.Fatal("message should have been dealt with")
+			}
+
+			if handler.calls != test.expectedCalls {
+				t.Errorf("handler called %d times, want %d", handler.calls, test.expectedCalls)
+			}
+
+			if !test.expectDead {
+				if len(sender.Sent["dlq"]) != 0 {
+					t.Error("was not expecting a dead letter")
+				}
+				return
+			}
+
+			if len(sender.Sent["dlq"]) != 1 {
+				t.Fatalf("was expecting one dead letter, got %d", len(sender.Sent["dlq"]))
+			}
+
+			d := DeadLetter{}
+			if err := json.Unmarshal([]byte(sender.Sent["dlq"][0]), &d); err != nil {
+				t.Fatal(err)
+			}
+
+			if d.Topic != "locations" || d.Partition != 1 || d.Offset != 42 || string(d.Value) != `{}` {
+				t.Errorf("dead letter does not reference the original message: %+v", d)
+			}
+
+			if d.Attempts != test.expectedCalls || d.Permanent != test.expectPermanent {
+				t.Errorf("unexpected dead letter metadata: %+v", d)
+			}
+		})
+	}
+}
+
+func TestMessageProcessorCancelled(t *testing.T) {
+	handler := &MockHandler{errs: []error{errors.New("database is down")}}
+	p := newMessageProcessor(handler, []ConsumerOption{
+		WithRetry(RetryPolicy{MaxRetries: 1, InitialBackoff: time.Hour}),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if p.process(ctx, &sarama.ConsumerMessage{}) {
+		t.Error("message should not be committed when consumer stops while waiting to retry")
+	}
+}
+
+func TestRedriver(t *testing.T) {
+	sender := &MockSender{Sent: map[string][]string{}}
+	d, _ := json.Marshal(DeadLetter{Topic: "locations", Value: []byte(`{"latitude":1}`)})
+
+	if err := NewRedriver(sender, "").HandleMessage(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sender.Sent["locations"]) != 1 || sender.Sent["locations"][0] != `{"latitude":1}` {
+		t.Errorf("original value was not re-published: %v", sender.Sent)
+	}
+}
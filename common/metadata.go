@@ -0,0 +1,111 @@
+package common
+
+import (
+	"context"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/satori/go.uuid"
+)
+
+// Kafka record headers carrying the metadata of a message
+const (
+	HeaderTraceID       = "trace-id"
+	HeaderMessageID     = "message-id"
+	HeaderProducer      = "producer"
+	HeaderSchemaVersion = "schema-version"
+	HeaderProducedAt    = "produced-at"
+	HeaderSubject       = "subject"
+)
+
+// Metadata describes a message independently of its payload. It is passed along with
+// the message through a context and travels on the wire as kafka record headers.
+type Metadata struct {
+	TraceID       string    `json:"trace_id,omitempty"`
+	MessageID     string    `json:"message_id,omitempty"`
+	Producer      string    `json:"producer,omitempty"`
+	SchemaVersion string    `json:"schema_version,omitempty"`
+	ProducedAt    time.Time `json:"produced_at,omitempty"`
+	// Subject is the authenticated caller the message was produced for, if any
+	Subject string `json:"subject,omitempty"`
+}
+
+type metadataKey struct{}
+
+// NewMetadata returns the metadata of a new message produced by producer with a new message ID
+func NewMetadata(traceID, producer, schemaVersion string) Metadata {
+	return Metadata{
+		TraceID:       traceID,
+		MessageID:     uuid.NewV4().String(),
+		Producer:      producer,
+		SchemaVersion: schemaVersion,
+		ProducedAt:    time.Now().UTC(),
+	}
+}
+
+// ContextWithMetadata returns a copy of ctx carrying m
+func ContextWithMetadata(ctx context.Context, m Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, m)
+}
+
+// MetadataFromContext returns the metadata carried by ctx, ok is false when there is none
+func MetadataFromContext(ctx context.Context) (m Metadata, ok bool) {
+	m, ok = ctx.Value(metadataKey{}).(Metadata)
+	return m, ok
+}
+
+// Headers converts m to kafka record headers, empty values are left out
+func (m Metadata) Headers() []sarama.RecordHeader {
+	values := [][2]string{
+		{HeaderTraceID, m.TraceID},
+		{HeaderMessageID, m.MessageID},
+		{HeaderProducer, m.Producer},
+		{HeaderSchemaVersion, m.SchemaVersion},
+		{HeaderSubject, m.Subject},
+	}
+
+	if !m.ProducedAt.IsZero() {
+		values = append(values, [2]string{HeaderProducedAt, formatTime(m.ProducedAt)})
+	}
+
+	headers := make([]sarama.RecordHeader, 0, len(values))
+	for _, v := range values {
+		if v[1] == "" {
+			continue
+		}
+		headers = append(headers, sarama.RecordHeader{Key: []byte(v[0]), Value: []byte(v[1])})
+	}
+
+	return headers
+}
+
+// MetadataFromHeaders reads the metadata of a consumed message, unknown headers are ignored
+func MetadataFromHeaders(headers []*sarama.RecordHeader) Metadata {
+	m := Metadata{}
+
+	for _, h := range headers {
+		if h == nil {
+			continue
+		}
+
+		value := string(h.Value)
+		switch string(h.Key) {
+		case HeaderTraceID:
+			m.TraceID = value
+		case HeaderMessageID:
+			m.MessageID = value
+		case HeaderProducer:
+			m.Producer = value
+		case HeaderSchemaVersion:
+			m.SchemaVersion = value
+		case HeaderSubject:
+			m.Subject = value
+		case HeaderProducedAt:
+			if t, err := parseTime(value); err == nil {
+				m.ProducedAt = t
+			}
+		}
+	}
+
+	return m
+}
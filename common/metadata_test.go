@@ -0,0 +1,39 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/go-test/deep"
+)
+
+func TestMetadataHeaders(t *testing.T) {
+	m := Metadata{
+		TraceID:       "trace",
+		MessageID:     "message",
+		Producer:      "gateway",
+		SchemaVersion: "1",
+		ProducedAt:    time.Date(2020, 10, 1, 12, 30, 0, 0, time.UTC),
+		Subject:       "driver-6",
+	}
+
+	// Consumed headers are pointers, produced headers are not
+	headers := []*sarama.RecordHeader{{Key: []byte("unknown"), Value: []byte("ignored")}}
+	for _, h := range m.Headers() {
+		h := h
+		headers = append(headers, &h)
+	}
+
+	if diff := deep.Equal(MetadataFromHeaders(headers), m); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestMetadataHeadersLeavesOutEmptyValues(t *testing.T) {
+	headers := Metadata{TraceID: "trace"}.Headers()
+
+	if len(headers) != 1 || string(headers[0].Key) != HeaderTraceID {
+		t.Errorf("was expecting only the trace-id header, got %v", headers)
+	}
+}
@@ -0,0 +1,122 @@
+package common
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsPath is where the services serve their metrics
+const MetricsPath = "/metrics"
+
+// Outcomes of a produced or consumed message, used as the `result` label
+const (
+	ResultOK    = "ok"
+	ResultError = "error"
+	// ResultRejected is a message the async producer had no room for
+	ResultRejected = "rejected"
+	// ResultDeadLetter is a message that could not be handled and was sent to the dead-letter queue
+	ResultDeadLetter = "dead_letter"
+)
+
+// Metrics shared by the services, they are registered in the default prometheus registry
+var (
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests handled, by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time taken to handle HTTP requests, by route, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	KafkaProduced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_messages_produced_total",
+		Help: "Messages published to kafka, by topic and result.",
+	}, []string{"topic", "result"})
+
+	KafkaConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_messages_consumed_total",
+		Help: "Messages consumed from kafka, by topic and result.",
+	}, []string{"topic", "result"})
+
+	KafkaConsumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kafka_consumer_lag",
+		Help: "Messages of a partition that are not consumed yet.",
+	}, []string{"topic", "partition"})
+
+	RedisDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "redis_operation_duration_seconds",
+		Help:    "Time taken by redis operations, by operation and result.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation", "result"})
+)
+
+// MetricsHandler serves the metrics in the prometheus text format
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// HTTPMetrics is a mux middleware counting and timing the requests by route template,
+// so that `/drivers/1` and `/drivers/2` are counted together
+func HTTPMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		status := strconv.Itoa(recorder.status)
+		HTTPRequests.WithLabelValues(route, r.Method, status).Inc()
+		HTTPRequestDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// ObserveRedis starts timing a redis operation, the returned function records its duration and outcome
+func ObserveRedis(operation string) func(error) {
+	start := time.Now()
+	return func(err error) {
+		RedisDuration.WithLabelValues(operation, resultOf(err)).Observe(time.Since(start).Seconds())
+	}
+}
+
+// ObserveLag records how many messages of a partition are left to consume once offset is handled,
+// highWaterMark being the offset of the next message published to it
+func ObserveLag(topic string, partition int32, highWaterMark, offset int64) {
+	lag := highWaterMark - offset - 1
+	if lag < 0 {
+		lag = 0
+	}
+	KafkaConsumerLag.WithLabelValues(topic, strconv.Itoa(int(partition))).Set(float64(lag))
+}
+
+func resultOf(err error) string {
+	if err != nil {
+		return ResultError
+	}
+	return ResultOK
+}
+
+// statusRecorder remembers the status written to a ResponseWriter
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streamed responses through the recorder
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
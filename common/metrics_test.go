@@ -0,0 +1,81 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHTTPMetrics(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/metrics-test/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["id"] == "missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	r.Use(HTTPMetrics)
+
+	// The counters are global, only what the test adds to them is checked
+	count := func(status string) float64 {
+		return testutil.ToFloat64(HTTPRequests.WithLabelValues("/metrics-test/{id}", http.MethodGet, status))
+	}
+	before := map[string]float64{"200": count("200"), "404": count("404")}
+
+	for _, path := range []string{"/metrics-test/1", "/metrics-test/2", "/metrics-test/missing"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	tests := []struct {
+		status string
+		want   float64
+	}{
+		{"200", 2},
+		{"404", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			if got := count(tt.status) - before[tt.status]; got != tt.want {
+				t.Errorf("was expecting %v requests, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHTTPMetricsKeepsFlusher(t *testing.T) {
+	handler := HTTPMetrics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("was expecting the ResponseWriter to be a http.Flusher")
+		}
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestObserveLag(t *testing.T) {
+	tests := []struct {
+		name          string
+		highWaterMark int64
+		offset        int64
+		want          float64
+	}{
+		{"behind", 10, 4, 5},
+		{"caught up", 10, 9, 0},
+		{"high water mark not refreshed yet", 10, 12, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ObserveLag("lag-test", 3, tt.highWaterMark, tt.offset)
+
+			if got := testutil.ToFloat64(KafkaConsumerLag.WithLabelValues("lag-test", "3")); got != tt.want {
+				t.Errorf("was expecting a lag of %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
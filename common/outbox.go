@@ -0,0 +1,250 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrOutboxFull is returned when storing a message would exceed the limits of the outbox
+var ErrOutboxFull = errors.New("outbox is full")
+
+const outboxExt = ".json"
+
+// outboxRecord is what is written to disk for every stored message
+type outboxRecord struct {
+	Topic    string   `json:"topic"`
+	Key      string   `json:"key,omitempty"`
+	Value    string   `json:"value"`
+	Metadata Metadata `json:"metadata"`
+}
+
+// Outbox is a disk-backed spool for messages that could not be published. Every message is
+// written to its own file named after a sequence number so that they are replayed in order,
+// and it survives a restart of the process. The outbox holds at most maxMessages messages
+// and maxBytes bytes, a zero limit means unlimited.
+type Outbox struct {
+	dir         string
+	maxMessages int
+	maxBytes    int64
+
+	mu    sync.Mutex
+	seq   uint64
+	count int
+	size  int64
+
+	replayMu sync.Mutex
+}
+
+// NewOutbox opens the outbox stored in dir, creating dir if needed, and picks up the
+// messages left by a previous run
+func NewOutbox(dir string, maxMessages int, maxBytes int64) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	o := &Outbox{dir: dir, maxMessages: maxMessages, maxBytes: maxBytes}
+
+	files, err := o.files()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		o.count++
+		o.size += f.Size()
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), outboxExt), 10, 64)
+		if err == nil && seq > o.seq {
+			o.seq = seq
+		}
+	}
+
+	if o.count > 0 {
+		log.Info().Int("messages", o.count).Int64("bytes", o.size).Str("dir", dir).Msg("outbox has messages to replay")
+	}
+
+	return o, nil
+}
+
+// Len returns the number of messages waiting to be replayed
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.count
+}
+
+// Store writes a message to disk, the Metadata carried by ctx is stored along with it
+func (o *Outbox) Store(ctx context.Context, topic, key, msg string) error {
+	meta, _ := MetadataFromContext(ctx)
+
+	b, err := json.Marshal(outboxRecord{Topic: topic, Key: key, Value: msg, Metadata: meta})
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if (o.maxMessages > 0 && o.count+1 > o.maxMessages) || (o.maxBytes > 0 && o.size+int64(len(b)) > o.maxBytes) {
+		return ErrOutboxFull
+	}
+
+	o.seq++
+	name := filepath.Join(o.dir, fmt.Sprintf("%020d%s", o.seq, outboxExt))
+
+	// Writing to a temporary file first means a crash never leaves a partial message behind
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0640); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+
+	o.count++
+	o.size += int64(len(b))
+
+	return nil
+}
+
+// Replay publishes the stored messages in order with sender and removes them from disk.
+// It stops at the first message that cannot be published, which is left for the next replay.
+func (o *Outbox) Replay(ctx context.Context, sender Sender) (int, error) {
+	o.replayMu.Lock()
+	defer o.replayMu.Unlock()
+
+	files, err := o.files()
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for _, f := range files {
+		if ctx.Err() != nil {
+			return replayed, ctx.Err()
+		}
+
+		name := filepath.Join(o.dir, f.Name())
+
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return replayed, err
+		}
+
+		r := outboxRecord{}
+		if err := json.Unmarshal(b, &r); err != nil {
+			// There is no way to ever publish it, keep it aside rather than blocking the outbox
+			log.Error().Err(err).Str("file", name).Msg("corrupted outbox message, moving it aside")
+			if err := os.Rename(name, name+".corrupted"); err != nil {
+				return replayed, err
+			}
+			o.remove(f.Size())
+			continue
+		}
+
+		if err := sender.Send(ContextWithMetadata(ctx, r.Metadata), r.Topic, r.Key, r.Value); err != nil {
+			return replayed, err
+		}
+
+		if err := os.Remove(name); err != nil {
+			return replayed, err
+		}
+		o.remove(f.Size())
+		replayed++
+	}
+
+	return replayed, nil
+}
+
+// Run replays the outbox every interval until ctx is cancelled
+func (o *Outbox) Run(ctx context.Context, sender Sender, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if o.Len() == 0 {
+			continue
+		}
+
+		replayed, err := o.Replay(ctx, sender)
+		if replayed > 0 {
+			log.Info().Int("replayed", replayed).Int("remaining", o.Len()).Msg("replayed messages from outbox")
+		}
+		if err != nil {
+			log.Warn().Err(err).Int("remaining", o.Len()).Msg("could not replay outbox")
+		}
+	}
+}
+
+func (o *Outbox) remove(size int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.count--
+	o.size -= size
+}
+
+// files returns the stored messages sorted by sequence number
+func (o *Outbox) files() ([]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(o.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := infos[:0]
+	for _, f := range infos {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), outboxExt) {
+			files = append(files, f)
+		}
+	}
+
+	// Sequence numbers are zero padded so the names sort in order
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+
+	return files, nil
+}
+
+// OutboxSender is a Sender storing in an outbox the messages its sender fails to publish.
+// Once the outbox holds messages, new ones are stored after them so that they are not
+// published ahead of the messages waiting to be replayed.
+type OutboxSender struct {
+	sender Sender
+	outbox *Outbox
+}
+
+func NewOutboxSender(sender Sender, outbox *Outbox) *OutboxSender {
+	return &OutboxSender{sender: sender, outbox: outbox}
+}
+
+// Send publishes msg or stores it in the outbox, it only fails when the outbox is full
+func (o *OutboxSender) Send(ctx context.Context, topic, key, msg string) error {
+	if o.outbox.Len() == 0 {
+		err := o.sender.Send(ctx, topic, key, msg)
+		if err == nil {
+			return nil
+		}
+
+		log.Warn().Err(err).Str("topic", topic).Msg("could not publish message, storing it in outbox")
+	}
+
+	return o.outbox.Store(ctx, topic, key, msg)
+}
@@ -0,0 +1,102 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+// FailingSender fails while down is true and records what it publishes otherwise
+type FailingSender struct {
+	down bool
+	sent []string
+}
+
+func (f *FailingSender) Send(ctx context.Context, topic, key, msg string) error {
+	if f.down {
+		return errors.New("broker is down")
+	}
+	f.sent = append(f.sent, msg)
+	return nil
+}
+
+func newTestOutbox(t *testing.T, maxMessages int, maxBytes int64) (*Outbox, string) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := NewOutbox(dir, maxMessages, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o, dir
+}
+
+func TestOutboxSender(t *testing.T) {
+	outbox, dir := newTestOutbox(t, 0, 0)
+	defer os.RemoveAll(dir)
+
+	broker := &FailingSender{down: true}
+	sender := NewOutboxSender(broker, outbox)
+	ctx := context.Background()
+
+	for _, msg := range []string{"1", "2"} {
+		if err := sender.Send(ctx, "locations", "", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Once the broker is back new messages still wait for the outbox to be replayed
+	broker.down = false
+	if err := sender.Send(ctx, "locations", "", "3"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(broker.sent) != 0 || outbox.Len() != 3 {
+		t.Fatalf("was expecting 3 messages in outbox, got %d and %d sent", outbox.Len(), len(broker.sent))
+	}
+
+	// Messages left by a previous run are picked up
+	reopened, err := NewOutbox(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, err := reopened.Replay(ctx, broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replayed != 3 || reopened.Len() != 0 {
+		t.Errorf("was expecting 3 messages replayed and none left, got %d and %d", replayed, reopened.Len())
+	}
+
+	if diff := deep.Equal(broker.sent, []string{"1", "2", "3"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestOutboxLimits(t *testing.T) {
+	ctx := context.Background()
+
+	outbox, dir := newTestOutbox(t, 2, 0)
+	defer os.RemoveAll(dir)
+
+	_ = outbox.Store(ctx, "locations", "", "1")
+	_ = outbox.Store(ctx, "locations", "", "2")
+	if err := outbox.Store(ctx, "locations", "", "3"); err != ErrOutboxFull {
+		t.Errorf("was expecting ErrOutboxFull when exceeding max messages, got %v", err)
+	}
+
+	outbox, dir = newTestOutbox(t, 0, 10)
+	defer os.RemoveAll(dir)
+
+	if err := outbox.Store(ctx, "locations", "", "a message that is too large"); err != ErrOutboxFull {
+		t.Errorf("was expecting ErrOutboxFull when exceeding max bytes, got %v", err)
+	}
+}
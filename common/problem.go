@@ -0,0 +1,80 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ContentTypeProblem is the media type of a Problem
+const ContentTypeProblem = "application/problem+json"
+
+// Error codes shared by the services, each service adds its own
+const (
+	CodeInvalidRequest = "invalid_request"
+	CodeInternalError  = "internal_error"
+)
+
+// Problem is the body of every error returned by the services, an RFC 7807 problem detail. Type is left
+// to about:blank so Title is the status text, clients tell errors apart with the Code extension member.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+
+	Code    string `json:"code"`
+	TraceID string `json:"trace_id"`
+	// Fields lists the fields of the request that are invalid
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError is a field of the request that is invalid
+type FieldError struct {
+	// Field is the path of the field, e.g `body.latitude` or `path.id`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// NewProblem returns the Problem of an error with status
+func NewProblem(status int, code, detail, traceID string) Problem {
+	return Problem{
+		Type:    "about:blank",
+		Title:   http.StatusText(status),
+		Status:  status,
+		Detail:  detail,
+		Code:    code,
+		TraceID: traceID,
+	}
+}
+
+// WriteProblem writes p with its status, its trace ID is returned in TraceIDHeader as well
+func WriteProblem(w http.ResponseWriter, p Problem) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		log.Error().Err(err).Str("traceID", p.TraceID).Msg("could not marshal problem")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentTypeProblem)
+	w.Header().Set(TraceIDHeader, p.TraceID)
+	w.WriteHeader(p.Status)
+
+	if _, err := w.Write(b); err != nil {
+		log.Error().Err(err).Str("traceID", p.TraceID).Msg("could not write problem")
+	}
+}
+
+// WriteError writes the Problem of an error with status
+func WriteError(w http.ResponseWriter, status int, code, detail, traceID string) {
+	WriteProblem(w, NewProblem(status, code, detail, traceID))
+}
+
+// WriteInvalidField writes the Problem of a request whose field, e.g `path.id`, is invalid
+func WriteInvalidField(w http.ResponseWriter, field, message, traceID string) {
+	p := NewProblem(http.StatusBadRequest, CodeInvalidRequest, field+" "+message, traceID)
+	p.Fields = []FieldError{{Field: field, Message: message}}
+	WriteProblem(w, p)
+}
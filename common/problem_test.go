@@ -0,0 +1,60 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestWriteProblem(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w http.ResponseWriter)
+		want  Problem
+	}{
+		{
+			name: "error",
+			write: func(w http.ResponseWriter) {
+				WriteError(w, http.StatusInternalServerError, CodeInternalError, "could not fetch locations", "trace-1")
+			},
+			want: Problem{Type: "about:blank", Title: "Internal Server Error", Status: 500, Detail: "could not fetch locations",
+				Code: CodeInternalError, TraceID: "trace-1"},
+		},
+		{
+			name: "invalid field",
+			write: func(w http.ResponseWriter) {
+				WriteInvalidField(w, "path.id", "must be an integer", "trace-1")
+			},
+			want: Problem{Type: "about:blank", Title: "Bad Request", Status: 400, Detail: "path.id must be an integer",
+				Code: CodeInvalidRequest, TraceID: "trace-1", Fields: []FieldError{{Field: "path.id", Message: "must be an integer"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.write(w)
+
+			if w.Code != tt.want.Status {
+				t.Errorf("was expecting status %d, got %d", tt.want.Status, w.Code)
+			}
+			if got := w.Header().Get("Content-Type"); got != ContentTypeProblem {
+				t.Errorf("was expecting content type %s, got %s", ContentTypeProblem, got)
+			}
+			if got := w.Header().Get(TraceIDHeader); got != tt.want.TraceID {
+				t.Errorf("was expecting trace ID %s, got %s", tt.want.TraceID, got)
+			}
+
+			got := Problem{}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
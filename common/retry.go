@@ -0,0 +1,80 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// RetryPolicy describes how many times a failed message is handled again and how long
+// to wait between two attempts. The wait doubles (or grows by Multiplier) after each attempt.
+type RetryPolicy struct {
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+}
+
+// NoRetry gives up on a message after the first failure
+var NoRetry = RetryPolicy{}
+
+// Backoff returns how long to wait before the given retry, starting at 1
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	if retry < 1 || p.InitialBackoff <= 0 {
+		return 0
+	}
+
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+
+	backoff := float64(p.InitialBackoff)
+	for i := 1; i < retry; i++ {
+		backoff *= multiplier
+		if p.MaxBackoff > 0 && backoff >= float64(p.MaxBackoff) {
+			return p.MaxBackoff
+		}
+	}
+
+	return time.Duration(backoff)
+}
+
+// permanentError marks an error that will not go away by handling the message again
+type permanentError struct {
+	err error
+}
+
+func (p permanentError) Error() string {
+	return p.err.Error()
+}
+
+func (p permanentError) Unwrap() error {
+	return p.err
+}
+
+func (p permanentError) Permanent() bool {
+	return true
+}
+
+// Permanent wraps err so that the message that caused it is not retried
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+// IsPermanent reports whether retrying cannot fix err. Errors can opt in by implementing
+// `Permanent() bool`, messages that cannot be unmarshalled are always permanent failures.
+func IsPermanent(err error) bool {
+	var p interface{ Permanent() bool }
+	if errors.As(err, &p) {
+		return p.Permanent()
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
@@ -0,0 +1,261 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters of the spans, the OTLP endpoint is read from the standard OTEL_EXPORTER_OTLP_ENDPOINT variable
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+)
+
+const instrumentationName = "github.com/heetch/MehdiSouilhed-technical-test/common"
+
+var tracer = otel.Tracer(instrumentationName)
+
+// untracedPaths are polled by probes and scrapers, tracing them would only bury the other traces
+var untracedPaths = map[string]bool{
+	LivenessPath:  true,
+	ReadinessPath: true,
+	MetricsPath:   true,
+}
+
+// InitTracing installs the tracer provider of service, exporting its spans with exporter, and the
+// W3C trace context propagator. Nothing is exported with ExporterNone, but the trace context of the
+// requests and messages is still passed on. The returned function flushes the spans not exported yet.
+func InitTracing(ctx context.Context, service, exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var exp sdktrace.SpanExporter
+	var err error
+
+	switch strings.ToLower(exporter) {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		exp, err = otlptracehttp.New(ctx)
+	case ExporterStdout:
+		exp, err = stdouttrace.New()
+	default:
+		return nil, fmt.Errorf("unknown traces exporter %q, expected %q, %q or %q", exporter, ExporterOTLP, ExporterStdout, ExporterNone)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(service))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// HTTPTracing is a mux middleware starting a server span named after the route template, it continues
+// the trace of the traceparent header of the request
+func HTTPTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		if untracedPaths[route] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPMethodKey.String(r.Method), semconv.HTTPRouteKey.String(route)),
+		)
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(recorder.status))
+		// Client errors are not errors of the server
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// tracingTransport starts a client span for the requests made on behalf of a traced operation
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+// NewTracingTransport returns a RoundTripper passing the trace context of the requests on in the
+// traceparent header. Requests made outside of a trace, such as health checks, are sent as they are.
+func NewTracingTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return tracingTransport{base: base}
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !trace.SpanContextFromContext(req.Context()).IsValid() {
+		return t.base.RoundTrip(req)
+	}
+
+	ctx, span := tracer.Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPClientAttributesFromHTTPRequest(req)...),
+	)
+	defer span.End()
+
+	// A RoundTripper must not modify the request it is given
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(res.StatusCode))
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(res.StatusCode))
+	return res, nil
+}
+
+// TraceRedis starts the span of a redis operation, the returned function ends it with the outcome of
+// the operation and records its duration
+func TraceRedis(ctx context.Context, operation string) (context.Context, func(error)) {
+	ctx, span := tracer.Start(ctx, "redis "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemRedis, semconv.DBOperationKey.String(operation)),
+	)
+	done := ObserveRedis(operation)
+
+	return ctx, func(err error) {
+		done(err)
+		endSpan(span, err)
+	}
+}
+
+// startProducerSpan starts the span of a message published to topic and adds its context to headers
+func startProducerSpan(ctx context.Context, topic string, headers *[]sarama.RecordHeader) trace.Span {
+	ctx, span := tracer.Start(ctx, topic+" send",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(messagingAttributes(topic)...),
+	)
+	otel.GetTextMapPropagator().Inject(ctx, producerHeaders{headers})
+	return span
+}
+
+// startConsumerSpan starts the span of the handling of msg, as a child of the span that published it
+func startConsumerSpan(ctx context.Context, msg *sarama.ConsumerMessage) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, consumerHeaders(msg.Headers))
+
+	attributes := append(messagingAttributes(msg.Topic),
+		semconv.MessagingOperationProcess,
+		semconv.MessagingKafkaPartitionKey.Int64(int64(msg.Partition)),
+		attribute.Int64("messaging.kafka.offset", msg.Offset),
+	)
+
+	return tracer.Start(ctx, msg.Topic+" process", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(attributes...))
+}
+
+func messagingAttributes(topic string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.MessagingSystemKey.String("kafka"),
+		semconv.MessagingDestinationKey.String(topic),
+		semconv.MessagingDestinationKindTopic,
+	}
+}
+
+// endSpan ends span, marking it as failed when err is not nil
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unknown"
+}
+
+// producerHeaders carries the trace context in the record headers of a produced message
+type producerHeaders struct {
+	headers *[]sarama.RecordHeader
+}
+
+func (p producerHeaders) Get(key string) string {
+	for _, h := range *p.headers {
+		if string(h.Key) == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func (p producerHeaders) Set(key, value string) {
+	for i, h := range *p.headers {
+		if string(h.Key) == key {
+			(*p.headers)[i].Value = []byte(value)
+			return
+		}
+	}
+	*p.headers = append(*p.headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+}
+
+func (p producerHeaders) Keys() []string {
+	keys := make([]string, 0, len(*p.headers))
+	for _, h := range *p.headers {
+		keys = append(keys, string(h.Key))
+	}
+	return keys
+}
+
+// consumerHeaders reads the trace context from the record headers of a consumed message
+type consumerHeaders []*sarama.RecordHeader
+
+func (c consumerHeaders) Get(key string) string {
+	for _, h := range c {
+		if h != nil && string(h.Key) == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// Set is not used, the headers of a consumed message are not modified
+func (c consumerHeaders) Set(key, value string) {}
+
+func (c consumerHeaders) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for _, h := range c {
+		if h != nil {
+			keys = append(keys, string(h.Key))
+		}
+	}
+	return keys
+}
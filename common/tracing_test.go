@@ -0,0 +1,193 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testTraceparent = "00-" + testTraceID + "-00f067aa0ba902b7-01"
+)
+
+var (
+	recorderOnce sync.Once
+	recorder     *tracetest.SpanRecorder
+)
+
+// recordSpans installs a tracer provider recording the spans of the tests. The tracer of the package
+// only follows the first provider installed, so it is shared by every test.
+func recordSpans() *tracetest.SpanRecorder {
+	recorderOnce.Do(func() {
+		recorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	return recorder
+}
+
+// endedSpan returns the last ended span called name
+func endedSpan(t *testing.T, r *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	spans := r.Ended()
+	for i := len(spans) - 1; i >= 0; i-- {
+		if spans[i].Name() == name {
+			return spans[i]
+		}
+	}
+	t.Fatalf("no span called %s", name)
+	return nil
+}
+
+func spanContextOf(traceparent string) trace.SpanContext {
+	header := http.Header{}
+	header.Set("traceparent", traceparent)
+	return trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), propagation.HeaderCarrier(header)))
+}
+
+func TestExtractTraceIDFromReq(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{"traceparent", map[string]string{"traceparent": testTraceparent, TraceIDHeader: "ignored"}, testTraceID},
+		{"trace id header", map[string]string{TraceIDHeader: "trace"}, "trace"},
+		{"invalid traceparent", map[string]string{"traceparent": "invalid", TraceIDHeader: "trace"}, "trace"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+
+			if got := ExtractTraceIDFromReq(r); got != tt.want {
+				t.Errorf("was expecting trace %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	if got := ExtractTraceIDFromReq(httptest.NewRequest(http.MethodGet, "/", nil)); got == "" {
+		t.Error("was expecting a new trace ID for a request without one")
+	}
+}
+
+func TestHTTPTracing(t *testing.T) {
+	spans := recordSpans()
+
+	r := mux.NewRouter()
+	r.HandleFunc("/trace-test/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if got := ExtractTraceIDFromReq(r); got != testTraceID {
+			t.Errorf("was expecting the handler to be part of trace %s, got %s", testTraceID, got)
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	r.Use(HTTPTracing)
+
+	req := httptest.NewRequest(http.MethodGet, "/trace-test/1", nil)
+	req.Header.Set("traceparent", testTraceparent)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	span := endedSpan(t, spans, "GET /trace-test/{id}")
+	if span.SpanKind() != trace.SpanKindServer {
+		t.Errorf("was expecting a server span, got %v", span.SpanKind())
+	}
+	if got := span.Parent().TraceID().String(); got != testTraceID {
+		t.Errorf("was expecting the span to continue trace %s, got %s", testTraceID, got)
+	}
+	if span.Status().Code != codes.Error {
+		t.Errorf("was expecting a 502 to fail the span, got %v", span.Status().Code)
+	}
+}
+
+func TestTracingTransport(t *testing.T) {
+	recordSpans()
+
+	received := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("traceparent")
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: NewTracingTransport(nil)}
+
+	parent := spanContextOf(testTraceparent)
+
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		wantTrace string
+	}{
+		{"outside of a trace", context.Background(), ""},
+		{"in a trace", trace.ContextWithRemoteSpanContext(context.Background(), parent), testTraceID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequestWithContext(tt.ctx, http.MethodGet, ts.URL, nil)
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			traceparent := <-received
+			got := spanContextOf(traceparent)
+
+			if tt.wantTrace == "" {
+				if traceparent != "" {
+					t.Errorf("was expecting no traceparent, got %s", traceparent)
+				}
+				return
+			}
+			if got.TraceID().String() != tt.wantTrace || got.SpanID() == parent.SpanID() {
+				t.Errorf("was expecting a client span of trace %s, got %s", tt.wantTrace, traceparent)
+			}
+		})
+	}
+}
+
+func TestKafkaTraceContext(t *testing.T) {
+	spans := recordSpans()
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "parent")
+	defer parent.End()
+
+	headers := Metadata{TraceID: "trace"}.Headers()
+	startProducerSpan(ctx, "locations", &headers).End()
+
+	consumed := &sarama.ConsumerMessage{Topic: "locations"}
+	for _, h := range headers {
+		h := h
+		consumed.Headers = append(consumed.Headers, &h)
+	}
+
+	_, span := startConsumerSpan(context.Background(), consumed)
+	span.End()
+
+	producer := endedSpan(t, spans, "locations send")
+	consumer := endedSpan(t, spans, "locations process")
+
+	if producer.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Error("was expecting the producer span to be a child of the span of the request")
+	}
+	if consumer.Parent().SpanID() != producer.SpanContext().SpanID() {
+		t.Error("was expecting the consumer span to be a child of the producer span")
+	}
+	if MetadataFromHeaders(consumed.Headers).TraceID != "trace" {
+		t.Error("was expecting the metadata headers to be kept")
+	}
+}
@@ -0,0 +1,25 @@
+package domain
+
+import "time"
+
+// Config holds the settings of the service, loaded by common/config from config.yaml,
+// the environment and the command line
+type Config struct {
+	KafkaBrokers []string `yaml:"kafka-brokers" default:"kafka1:9092" validate:"min=1"`
+	QueueTopic   string   `yaml:"queue-topic" validate:"required"`
+	QueueGroup   string   `yaml:"queue-group" validate:"required"`
+	QueueOffset  string   `yaml:"queue-offset" validate:"omitempty,oneof=oldest newest"`
+
+	DatabaseHost     string `yaml:"database-host" validate:"required"`
+	DatabasePort     int    `yaml:"database-port" default:"6379" validate:"required"`
+	DatabasePassword string `yaml:"database-password" secret:"true"`
+
+	// Failed messages are retried with an exponential backoff and then published to the dead-letter topic
+	QueueMaxRetries      int           `yaml:"queue-max-retries" validate:"min=0"`
+	QueueRetryBackoff    time.Duration `yaml:"queue-retry-backoff"`
+	QueueMaxBackoff      time.Duration `yaml:"queue-max-backoff"`
+	QueueDeadLetterTopic string        `yaml:"queue-dead-letter-topic"`
+
+	Addr           string `yaml:"addr" default:":80"`
+	TracesExporter string `yaml:"traces-exporter" env:"OTEL_TRACES_EXPORTER" validate:"omitempty,oneof=none otlp stdout"`
+}
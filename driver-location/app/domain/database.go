@@ -1,18 +1,20 @@
 package domain
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"sort"
 	"time"
 
 	"github.com/go-redis/redis"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
 )
 
 // DB is an interface to a database where pings will be stored
 type DB interface {
-	Save(driverID string, coordinates Coordinates, time time.Time) error
-	Fetch(driverID string, minutes int) (*[]Coordinates, error)
+	Save(ctx context.Context, driverID string, coordinates Coordinates, time time.Time) error
+	Fetch(ctx context.Context, driverID string, minutes int) (*[]Coordinates, error)
 	Ping() error
 }
 
@@ -27,14 +29,16 @@ func NewInMemoryDB(client *redis.Client) *InMemoryDB {
 }
 
 func (d *InMemoryDB) Ping() error {
+	done := common.ObserveRedis("ping")
 	_, err := d.client.Ping().Result()
+	done(err)
 	return err
 }
 
 // Save takes an updatedAt value and persists coordinates for a driverID
-func (d *InMemoryDB) Save(driverID string, coordinates Coordinates, time time.Time) error {
+func (d *InMemoryDB) Save(ctx context.Context, driverID string, coordinates Coordinates, updatedAt time.Time) error {
 
-	coordinates.SetUpdatedAt(time)
+	coordinates.SetUpdatedAt(updatedAt)
 	c, err := json.Marshal(coordinates)
 	if err != nil {
 		return err
@@ -42,13 +46,18 @@ func (d *InMemoryDB) Save(driverID string, coordinates Coordinates, time time.Ti
 
 	log.Printf("saving coordinates for driver %s", driverID)
 
-	return d.client.SAdd(driverID, c).Err()
+	ctx, done := common.TraceRedis(ctx, "sadd")
+	err = d.client.WithContext(ctx).SAdd(driverID, c).Err()
+	done(err)
+	return err
 }
 
 // Fetch retrieves coordinates for a driverID given they are not older than `minutes`
-func (d *InMemoryDB) Fetch(driverID string, minutes int) (*[]Coordinates, error) {
+func (d *InMemoryDB) Fetch(ctx context.Context, driverID string, minutes int) (*[]Coordinates, error) {
 
-	res, err := d.client.SMembers(driverID).Result()
+	ctx, done := common.TraceRedis(ctx, "smembers")
+	res, err := d.client.WithContext(ctx).SMembers(driverID).Result()
+	done(err)
 	if err != nil {
 		return nil, err
 	}
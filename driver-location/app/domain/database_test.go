@@ -3,6 +3,7 @@
 package domain
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -146,10 +147,10 @@ func TestDatabase(t *testing.T) {
 		t.Run(test.name, func(t *testing.T) {
 
 			for _, c := range test.coordinates {
-				_ = database.Save(test.driverID, c, c.UpdatedAt.Time)
+				_ = database.Save(context.Background(), test.driverID, c, c.UpdatedAt.Time)
 			}
 
-			res, _ := database.Fetch(test.driverID, 5)
+			res, _ := database.Fetch(context.Background(), test.driverID, 5)
 
 			if diff := deep.Equal(res, test.expected); diff != nil {
 				t.Error(diff)
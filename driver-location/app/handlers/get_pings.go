@@ -30,21 +30,24 @@ const (
 	logTraceID = "traceID"
 )
 
+// CodeLocationsUnavailable is returned when the locations cannot be read from the database
+const CodeLocationsUnavailable = "locations_unavailable"
+
 // GetDriversPings will fetch pings from the database
 func (s *RequestHandler) GetDriverPings(w http.ResponseWriter, r *http.Request) {
 	traceID := common.ExtractTraceIDFromReq(r)
 
 	id, err := common.GetIntVariableValue(r, courierID)
 	if err != nil {
-		log.Error().Err(err).Str(logTraceID, traceID)
-		w.WriteHeader(http.StatusBadRequest)
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("invalid driver ID")
+		common.WriteInvalidField(w, "path."+courierID, "must be an integer", traceID)
 		return
 	}
 
 	m, err := common.GetIntParamValue(r, minutes)
 	if err != nil {
-		log.Error().Err(err).Str(logTraceID, traceID)
-		w.WriteHeader(http.StatusBadRequest)
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("invalid minutes")
+		common.WriteInvalidField(w, "query."+minutes, "must be an integer", traceID)
 		return
 	}
 
@@ -52,25 +55,23 @@ func (s *RequestHandler) GetDriverPings(w http.ResponseWriter, r *http.Request)
 		m = defaultMinutes
 	}
 
-	pings, err := s.database.Fetch(strconv.Itoa(id), m)
+	pings, err := s.database.Fetch(r.Context(), strconv.Itoa(id), m)
 
 	if err != nil {
-		log.Error().Err(err).Str(logTraceID, traceID)
-		w.WriteHeader(http.StatusInternalServerError)
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not fetch locations")
+		common.WriteError(w, http.StatusInternalServerError, CodeLocationsUnavailable, "could not fetch locations", traceID)
 		return
 	}
 
 	response, err := json.Marshal(pings)
 	if err != nil {
-		log.Error().Err(err).Str(logTraceID, traceID)
-		w.WriteHeader(http.StatusBadRequest)
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not marshal locations")
+		common.WriteError(w, http.StatusInternalServerError, common.CodeInternalError, "could not marshal locations", traceID)
 		return
 	}
 
 	_, err = w.Write(response)
 	if err != nil {
-		log.Error().Err(err).Str(logTraceID, traceID)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not write response")
 	}
 }
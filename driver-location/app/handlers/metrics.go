@@ -0,0 +1,12 @@
+package handlers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// pingsSaved counts the locations consumed from the queue and stored in the database
+var pingsSaved = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "driver_location_pings_saved_total",
+	Help: "Driver locations saved to the database.",
+})
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/heetch/MehdiSouilhed-technical-test/common"
 	"github.com/heetch/MehdiSouilhed-technical-test/driver-location/app/domain"
@@ -30,8 +31,13 @@ func (m MissingDriverID) Error() string {
 	return m.message
 }
 
+// Permanent tells the consumer that the message should not be retried
+func (m MissingDriverID) Permanent() bool {
+	return true
+}
+
 // HandleMessage will unmarshal a message from the queue and save it to the database
-func (s SaveToDB) HandleMessage(message []byte) error {
+func (s SaveToDB) HandleMessage(ctx context.Context, message []byte) error {
 	m := domain.Message{}
 
 	// First unmarshal the envelope
@@ -41,7 +47,14 @@ func (s SaveToDB) HandleMessage(message []byte) error {
 		return err
 	}
 
-	traceID := m.Parameters[common.TraceIDHeader]
+	// The traceID travels in the record headers, messages produced before that
+	// carry it inside the envelope parameters
+	meta, _ := common.MetadataFromContext(ctx)
+	traceID := meta.TraceID
+	if traceID == "" {
+		traceID = m.Parameters[common.TraceIDHeader]
+	}
+
 	location := domain.Coordinates{}
 
 	// Second unmarshal the content of the message
@@ -56,5 +69,10 @@ func (s SaveToDB) HandleMessage(message []byte) error {
 	} else {
 		return MissingDriverID{"no driver id found in message"}
 	}
-	return s.database.Save(location.DriverID, location, time.Now())
+	if err := s.database.Save(ctx, location.DriverID, location, time.Now()); err != nil {
+		return err
+	}
+
+	pingsSaved.Inc()
+	return nil
 }
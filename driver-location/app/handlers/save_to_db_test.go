@@ -1,13 +1,13 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/heetch/MehdiSouilhed-technical-test/driver-location/app/domain"
-	"github.com/nsqio/go-nsq"
 	. "github.com/onsi/gomega"
 )
 
@@ -15,13 +15,13 @@ type MockDB struct {
 	store map[string][]domain.Coordinates
 }
 
-func (m *MockDB) Save(driverID string, coordinates domain.Coordinates, time time.Time) error {
+func (m *MockDB) Save(ctx context.Context, driverID string, coordinates domain.Coordinates, time time.Time) error {
 	coordinates.SetUpdatedAt(time)
 	m.store[driverID] = append(m.store[driverID], coordinates)
 	return nil
 }
 
-func (m MockDB) Fetch(driverID string, minutes int) (*[]domain.Coordinates, error) {
+func (m MockDB) Fetch(ctx context.Context, driverID string, minutes int) (*[]domain.Coordinates, error) {
 	val := m.store[driverID]
 	return &val, nil
 }
@@ -72,13 +72,13 @@ func TestHandleMessage(t *testing.T) {
 			}
 
 			// HandleMessage will save it to db
-			err = handler.HandleMessage(&nsq.Message{Body: body})
+			err = handler.HandleMessage(context.Background(), body)
 			if err != nil && test.expectErr == nil {
 				t.Log(err)
 			}
 
 			// Fetching it from the mock DB
-			res, err := m.Fetch(test.driverID, 0)
+			res, err := m.Fetch(context.Background(), test.driverID, 0)
 			if err != nil {
 				t.Log(err)
 			}
@@ -137,7 +137,7 @@ func TestHandleMessageErrors(t *testing.T) {
 			}
 
 			// HandleMessage will save it to db
-			err = handler.HandleMessage(&nsq.Message{Body: body})
+			err = handler.HandleMessage(context.Background(), body)
 			if err != nil && test.expectErr == nil {
 				t.Log(err)
 			}
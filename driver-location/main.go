@@ -1,82 +1,126 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/Shopify/sarama"
 	"github.com/go-redis/redis"
 	"github.com/gorilla/mux"
 	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/heetch/MehdiSouilhed-technical-test/common/config"
 	"github.com/heetch/MehdiSouilhed-technical-test/driver-location/app/domain"
 	"github.com/heetch/MehdiSouilhed-technical-test/driver-location/app/handlers"
 	"log"
 	"net/http"
 	"os"
-	"sync"
-	"time"
 )
 
 func main() {
-	time.Sleep(10 * time.Second)
-
 	// Loading and validating configuration, if we dont have required config we will exit rather
 	// than fail while the service is running
-	c, err := domain.NewConfig("config.yaml")
+	c := domain.Config{}
+	config.MustLoad(&c, "config.yaml")
+
+	// Components are stopped in the reverse order they are added: the server stops accepting requests,
+	// then the messages being handled are finished, before the connections are closed
+	lifecycle := common.NewLifecycle(common.DefaultShutdownTimeout)
+
+	shutdownTracing, err := common.InitTracing(context.Background(), "driver-location", c.TracesExporter)
 	if err != nil {
-		log.Print(os.Getwd())
-		log.Print(err)
-		os.Exit(1)
+		log.Panic(err)
 	}
+	lifecycle.OnStop("tracing", shutdownTracing)
 
 	// Initialise database connection
 	dbAddr := fmt.Sprintf("%s:%d", c.DatabaseHost, c.DatabasePort)
 	log.Printf("Connecting to database at %s", dbAddr)
-	database := domain.NewInMemoryDB(redis.NewClient(&redis.Options{Addr: dbAddr}))
-
-	// Check the connection to DB
-	err = database.Ping()
-	if err != nil {
-		log.Print(err)
-		// having different exit code enables to localise errors quicker
-		os.Exit(2)
-	}
+	client := redis.NewClient(&redis.Options{Addr: dbAddr, Password: c.DatabasePassword})
+	lifecycle.OnStop("redis", func(context.Context) error {
+		return client.Close()
+	})
+	database := domain.NewInMemoryDB(client)
 
 	// Instantiate queue handler
 	s := handlers.NewSaveToDB(database)
 
+	brokers := c.KafkaBrokers
+
+	// Messages that still fail after all retries are kept on the dead-letter topic
+	// so that they can be inspected and re-driven
+	opts := []common.ConsumerOption{common.WithRetry(common.RetryPolicy{
+		MaxRetries:     c.QueueMaxRetries,
+		InitialBackoff: c.QueueRetryBackoff,
+		MaxBackoff:     c.QueueMaxBackoff,
+	})}
+
+	// Redis and kafka are connected to in the background with a backoff, the service is not ready
+	// until they are and messages are only consumed once they can be handled
+	lifecycle.Go("consumer", func(ctx context.Context) error {
+		if err := common.Connect(ctx, "redis", common.ConnectPolicy, database.Ping); err != nil {
+			return err
+		}
+
+		if c.QueueDeadLetterTopic != "" {
+			producerConfig := sarama.NewConfig()
+			producerConfig.Version = sarama.V2_3_0_0
+			producerConfig.Producer.RequiredAcks = sarama.WaitForAll
+			producerConfig.Producer.Return.Successes = true
+
+			var producer sarama.SyncProducer
+			err := common.Connect(ctx, "dead-letter producer", common.ConnectPolicy, func() (err error) {
+				producer, err = sarama.NewSyncProducer(brokers, producerConfig)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			// Closed once the messages being handled are finished
+			defer producer.Close()
+
+			dlq := common.NewDeadLetterQueue(common.NewKafkaSender(producer), c.QueueDeadLetterTopic)
+			opts = append(opts, common.WithDeadLetterQueue(dlq))
+		}
+
+		// Every replica joins the same consumer group so that the partitions of the topic are shared between them
+		var stream *common.KafkaGroupConsumer
+		err := common.Connect(ctx, "consumer group", common.ConnectPolicy, func() (err error) {
+			stream, err = common.NewKafkaGroupConsumerFromConfig(common.ConsumerGroupConfig{
+				Brokers:       brokers,
+				GroupID:       c.QueueGroup,
+				InitialOffset: c.QueueOffset,
+			}, s, opts...)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		return stream.Receive(ctx, c.QueueTopic)
+	})
+
+	// The service is ready once redis and kafka can be reached
+	health := common.NewHealth(common.DefaultHealthInterval, common.DefaultHealthTimeout)
+	health.Register("redis", func(context.Context) error { return database.Ping() })
+	health.Register("kafka", common.KafkaCheck(brokers))
+	lifecycle.Go("health", func(ctx context.Context) error {
+		health.Run(ctx)
+		return nil
+	})
+
 	// Instantiate http router
 	r := mux.NewRouter()
 
 	// Register http handler
 	handler := handlers.NewRequestHandler(database)
 	r.HandleFunc("/drivers/{id}/locations", handler.GetDriverPings)
+	r.Handle(common.MetricsPath, common.MetricsHandler())
+	health.Handle(r)
+	r.Use(common.HTTPTracing, common.HTTPMetrics)
 
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
+	lifecycle.Server("http", &http.Server{Addr: c.Addr, Handler: r})
 
-	// ListenAndServe is a blocking operation - putting it in a goroutine
-	go func() {
-		defer wg.Done()
-		port := 80
-		fmt.Printf("Listening on port %d", port)
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), r))
-	}()
-
-	// Starting queue listener
-	topic := "locations"
-	//	partition := 0
-	//	offsetType := kingpin.Flag("offsetType", "Offset Type (OffsetNewest | OffsetOldest)").Default("-1").Int()
-
-	config := sarama.NewConfig()
-	config.Consumer.Return.Errors = true
-
-	consumer, err := sarama.NewConsumer([]string{"kafka1:9092"}, config)
-	if err != nil {
-		log.Panic(err)
+	if err := lifecycle.Run(context.Background()); err != nil {
+		log.Print(err)
+		os.Exit(1)
 	}
-
-	stream := common.NewKafkaConsumer(consumer, s)
-
-	stream.Receive(topic)
-
-	wg.Wait()
 }
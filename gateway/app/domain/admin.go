@@ -0,0 +1,243 @@
+package domain
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+// Backend types of a route
+const (
+	BackendQueue = "queue"
+	BackendHTTP  = "http"
+)
+
+// Error codes returned by the admin API
+const (
+	CodeInvalidRoute  = "invalid_route"
+	CodeRouteNotFound = "route_not_found"
+)
+
+var errRouteNotFound = errors.New("route not found")
+
+// RouteInfo describes a route registered on the gateway
+type RouteInfo struct {
+	Method  string `json:"method"`
+	Path    string `json:"path"`
+	Backend string `json:"backend"`
+	// Target is the topic of a queue route or the comma separated hosts of an http route
+	Target string `json:"target"`
+}
+
+// invalidRouteError is returned when a route change would result in an invalid config
+type invalidRouteError struct {
+	err error
+}
+
+func (i invalidRouteError) Error() string {
+	return i.err.Error()
+}
+
+// Admin exposes the routes of a RequestHandler and lets them be changed at runtime.
+// It is meant to be served on its own listener, away from public traffic.
+type Admin struct {
+	handler *RequestHandler
+	// filename is where the config is written after every change so that it survives a restart
+	filename string
+	// token is the bearer token every request must carry, requests are not authenticated when it is empty
+	token string
+}
+
+func NewAdmin(handler *RequestHandler, filename, token string) *Admin {
+	return &Admin{handler: handler, filename: filename, token: token}
+}
+
+// Router returns the router of the admin API
+func (a *Admin) Router() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/routes", a.ListRoutes).Methods(http.MethodGet)
+	r.HandleFunc("/admin/routes", a.AddRoute).Methods(http.MethodPost)
+	r.HandleFunc("/admin/routes", a.RemoveRoute).Methods(http.MethodDelete)
+	r.HandleFunc("/admin/config", a.GetConfig).Methods(http.MethodGet)
+	r.HandleFunc("/admin/breakers", a.ListBreakers).Methods(http.MethodGet)
+	r.Use(a.authenticate)
+	r.NotFoundHandler = http.HandlerFunc(notFound)
+	return r
+}
+
+// authenticate only lets the requests carrying the admin token through
+func (a *Admin) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.token != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, CodeUnauthorized, "a valid admin token is required", common.ExtractTraceIDFromReq(r))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ListRoutes returns the routes currently registered
+func (a *Admin) ListRoutes(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	config := a.handler.GetConfig()
+	routes := make([]RouteInfo, 0, len(config.Urls))
+
+	for _, u := range config.Urls {
+		info := RouteInfo{Method: strings.ToUpper(u.Method), Path: u.Path}
+		switch {
+		case u.Nsq != nil:
+			info.Backend, info.Target = BackendQueue, u.Nsq.Topic
+		case u.HTTP != nil:
+			info.Backend, info.Target = BackendHTTP, strings.Join(u.HTTP.Upstreams(), ",")
+		}
+		routes = append(routes, info)
+	}
+
+	writeJSON(w, http.StatusOK, traceID, routes)
+}
+
+// GetConfig returns the current routes in the yaml format of the routes file
+func (a *Admin) GetConfig(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	b, err := yaml.Marshal(a.handler.GetConfig())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternalError, err.Error(), traceID)
+		return
+	}
+
+	w.Header().Set(headerContentType, contentTypeYAML)
+	w.Header().Set(common.TraceIDHeader, traceID)
+	if _, err := w.Write(b); err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not write response")
+	}
+}
+
+// ListBreakers returns the state and counters of the circuit breakers of the current routes
+func (a *Admin) ListBreakers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, common.ExtractTraceIDFromReq(r), a.handler.Breakers())
+}
+
+// AddRoute registers the route in the body, a route of the routes file in yaml or JSON with the same
+// keys, e.g `{"path": "/drivers/{id}", "http": {"host": "zombie-driver", "timeout": "2s"}}`. Unknown keys
+// are rejected.
+func (a *Admin) AddRoute(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodyBytes))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidBody, "could not read body", traceID)
+		return
+	}
+
+	// A misspelt key would otherwise install the route without its rate limit, breaker or auth
+	route := URL{}
+	if err := yaml.UnmarshalStrict(body, &route); err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidBody, err.Error(), traceID)
+		return
+	}
+
+	if route.Method == "" || route.Path == "" || (route.Nsq == nil) == (route.HTTP == nil) {
+		writeError(w, http.StatusBadRequest, CodeInvalidRoute,
+			"a route needs a method, a path and exactly one of nsq or http", traceID)
+		return
+	}
+
+	err = a.update(func(c Config) (Config, error) {
+		urls := append([]URL{}, c.Urls...)
+		c.Urls = append(urls, route)
+		return c, nil
+	})
+	if err != nil {
+		a.writeUpdateError(w, err, traceID)
+		return
+	}
+
+	log.Info().Str(logTraceID, traceID).Str("method", route.Method).Str("path", route.Path).Msg("route added")
+	w.Header().Set(common.TraceIDHeader, traceID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// RemoveRoute removes the route given by the `method` and `path` query parameters
+func (a *Admin) RemoveRoute(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	method := strings.ToUpper(r.URL.Query().Get("method"))
+	path := r.URL.Query().Get("path")
+
+	err := a.update(func(c Config) (Config, error) {
+		urls := make([]URL, 0, len(c.Urls))
+		for _, u := range c.Urls {
+			if strings.ToUpper(u.Method) != method || u.Path != path {
+				urls = append(urls, u)
+			}
+		}
+
+		if len(urls) == len(c.Urls) {
+			return Config{}, errRouteNotFound
+		}
+
+		c.Urls = urls
+		return c, nil
+	})
+	if err != nil {
+		a.writeUpdateError(w, err, traceID)
+		return
+	}
+
+	log.Info().Str(logTraceID, traceID).Str("method", method).Str("path", path).Msg("route removed")
+	w.Header().Set(common.TraceIDHeader, traceID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// update changes the routes and persists the new config before it is applied,
+// so that the routes are left untouched if it cannot be written
+func (a *Admin) update(change func(Config) (Config, error)) error {
+	_, err := a.handler.Update(func(current Config) (Config, error) {
+		c, err := change(current)
+		if err != nil {
+			return Config{}, err
+		}
+
+		if err := c.Validate(); err != nil {
+			return Config{}, invalidRouteError{err: err}
+		}
+
+		if a.filename != "" {
+			if err := WriteFileConfig(a.filename, c); err != nil {
+				return Config{}, fmt.Errorf("could not persist config: %v", err)
+			}
+		}
+
+		return c, nil
+	})
+
+	return err
+}
+
+func (a *Admin) writeUpdateError(w http.ResponseWriter, err error, traceID string) {
+	var invalid invalidRouteError
+
+	switch {
+	case err == errRouteNotFound:
+		writeError(w, http.StatusNotFound, CodeRouteNotFound, err.Error(), traceID)
+	case errors.As(err, &invalid):
+		writeError(w, http.StatusBadRequest, CodeInvalidRoute, err.Error(), traceID)
+	default:
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not update routes")
+		writeError(w, http.StatusInternalServerError, CodeInternalError, err.Error(), traceID)
+	}
+}
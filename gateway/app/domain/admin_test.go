@@ -0,0 +1,157 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/gorilla/mux"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+)
+
+func TestAdmin(t *testing.T) {
+	f, err := ioutil.TempFile("", "config*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	m := &MockQueue{Queue: map[string][][]byte{}}
+	r, _ := NewRequestHandler(m, &http.Client{}, mux.NewRouter())
+	r.Gateway(Config{
+		Urls: []URL{
+			{Method: "PATCH", Path: "/drivers/{id}/locations", Nsq: &Topic{Topic: "locations"}},
+		},
+	})
+
+	admin := NewAdmin(r, f.Name(), "").Router()
+
+	do := func(method, target string, body []byte) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, target, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		admin.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Add a route, durations are written as in the routes file
+	rr := do("POST", "/admin/routes", []byte(`{"method":"GET","path":"/drivers/{id}","http":{"host":"zombie-driver","timeout":"2s"}}`))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("add route returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	// The same route again is rejected
+	rr = do("POST", "/admin/routes", []byte(`{"method":"GET","path":"/drivers/{id}","http":{"host":"zombie-driver"}}`))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("duplicate route returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	// Keys that are not those of the routes file are rejected rather than ignored
+	rr = do("POST", "/admin/routes", []byte(`{"method":"POST","path":"/drivers/{id}","http":{"host":"zombie-driver"},`+
+		`"rate_limit":{"requests":1,"period":"1s","key":"ip"}}`))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("route with an unknown key returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	rr = do("GET", "/admin/routes", nil)
+	routes := []RouteInfo{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &routes); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []RouteInfo{
+		{Method: "PATCH", Path: "/drivers/{id}/locations", Backend: BackendQueue, Target: "locations"},
+		{Method: "GET", Path: "/drivers/{id}", Backend: BackendHTTP, Target: "zombie-driver"},
+	}
+	if diff := deep.Equal(routes, expected); diff != nil {
+		t.Error(diff)
+	}
+
+	// Runtime changes are persisted
+	persisted, err := ParseFileConfig(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(persisted.Urls) != 2 || persisted.Urls[1].HTTP.Host != "zombie-driver" || persisted.Urls[1].HTTP.Timeout != 2*time.Second {
+		t.Errorf("config was not persisted: %+v", persisted)
+	}
+
+	// The config is read back in the format of the routes file
+	rr = do("GET", "/admin/config", nil)
+	current, err := ParseConfig(rr.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(current, persisted); diff != nil {
+		t.Error(diff)
+	}
+	if !bytes.Contains(rr.Body.Bytes(), []byte("timeout: 2s")) {
+		t.Errorf("was expecting durations as in the routes file, got\n%s", rr.Body.String())
+	}
+
+	// Remove a route
+	query := url.Values{"method": {"PATCH"}, "path": {"/drivers/{id}/locations"}}.Encode()
+	rr = do("DELETE", "/admin/routes?"+query, nil)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("remove route returned wrong status code: got %v want %v", rr.Code, http.StatusNoContent)
+	}
+
+	rr = do("DELETE", "/admin/routes?"+query, nil)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("remove unknown route returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	req, _ := http.NewRequest("PATCH", "/drivers/1/locations", bytes.NewReader([]byte(`{}`)))
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("removed route is still served: got %v", rr.Code)
+	}
+	p := common.Problem{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil || rr.Header().Get(headerContentType) != common.ContentTypeProblem {
+		t.Fatalf("was expecting a problem, got %s %q", rr.Header().Get(headerContentType), rr.Body.String())
+	}
+	if p.Code != CodeNotFound || p.TraceID == "" || p.TraceID != rr.Header().Get(common.TraceIDHeader) {
+		t.Errorf("unexpected problem %+v", p)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	r, _ := NewRequestHandler(&MockQueue{Queue: map[string][][]byte{}}, &http.Client{}, mux.NewRouter())
+	r.Gateway(Config{})
+	admin := NewAdmin(r, "", "s3cret").Router()
+
+	tests := []struct {
+		name          string
+		authorization string
+		expectedCode  int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer nope", http.StatusUnauthorized},
+		{"token", "Bearer s3cret", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/admin/routes", nil)
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			rr := httptest.NewRecorder()
+			admin.ServeHTTP(rr, req)
+
+			if rr.Code != test.expectedCode {
+				t.Errorf("got status %v want %v", rr.Code, test.expectedCode)
+			}
+		})
+	}
+}
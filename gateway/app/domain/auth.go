@@ -0,0 +1,284 @@
+package domain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultAPIKeyHeader carries the API key of the api-key authenticators that do not set a header
+const DefaultAPIKeyHeader = "X-Api-Key"
+
+const (
+	headerAuthorization   = "Authorization"
+	headerWWWAuthenticate = "WWW-Authenticate"
+
+	defaultSubjectClaim = "sub"
+	defaultScopeClaim   = "scope"
+)
+
+// errNoCredentials is returned by an identityProvider when the request carries no credentials it knows of
+var errNoCredentials = errors.New("no credentials")
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	Subject string
+	Scopes  map[string]bool
+	// Claims are the claims of the token, or the subject and scopes of an API key
+	Claims map[string]interface{}
+}
+
+// identityProvider authenticates the caller of a request, it returns errNoCredentials when the request
+// carries no credentials it knows of so that the next authenticator of the route can be tried
+type identityProvider interface {
+	authenticate(r *http.Request) (Identity, error)
+	// credentialsHeader is the header carrying the credentials, it is not forwarded upstream
+	credentialsHeader() string
+}
+
+// APIKey is an entry of the keys file of an api-key authenticator
+type APIKey struct {
+	Key     string   `yaml:"key"`
+	Subject string   `yaml:"subject"`
+	Scopes  []string `yaml:"scopes"`
+}
+
+type apiKeyProvider struct {
+	header string
+	keys   map[string]APIKey
+}
+
+type jwtProvider struct {
+	verifier     tokenVerifier
+	subjectClaim string
+	scopeClaim   string
+	claimScopes  map[string]map[string][]string
+}
+
+func newIdentityProvider(a Authenticator) (identityProvider, error) {
+	switch a.Type {
+	case AuthAPIKey:
+		return newAPIKeyProvider(a)
+	case AuthJWT:
+		return newJWTProvider(a)
+	}
+	return nil, fmt.Errorf("unknown authenticator type %q", a.Type)
+}
+
+func newAPIKeyProvider(a Authenticator) (*apiKeyProvider, error) {
+	if a.KeysFile == "" {
+		return nil, fmt.Errorf("api-key authenticator needs a keys-file")
+	}
+
+	source, err := ioutil.ReadFile(a.KeysFile)
+	if err != nil {
+		return nil, err
+	}
+
+	file := struct {
+		Keys []APIKey `yaml:"keys"`
+	}{}
+	if err := yaml.Unmarshal(source, &file); err != nil {
+		return nil, err
+	}
+
+	p := &apiKeyProvider{header: a.Header, keys: map[string]APIKey{}}
+	if p.header == "" {
+		p.header = DefaultAPIKeyHeader
+	}
+
+	for _, k := range file.Keys {
+		if k.Key == "" || k.Subject == "" {
+			return nil, fmt.Errorf("every key of %s needs a key and a subject", a.KeysFile)
+		}
+		p.keys[k.Key] = k
+	}
+
+	return p, nil
+}
+
+func (p *apiKeyProvider) credentialsHeader() string {
+	return p.header
+}
+
+func (p *apiKeyProvider) authenticate(r *http.Request) (Identity, error) {
+	key := r.Header.Get(p.header)
+	if key == "" {
+		return Identity{}, errNoCredentials
+	}
+
+	k, ok := p.keys[key]
+	if !ok {
+		return Identity{}, errors.New("unknown API key")
+	}
+
+	scopes := map[string]bool{}
+	for _, s := range k.Scopes {
+		scopes[s] = true
+	}
+
+	return Identity{
+		Subject: k.Subject,
+		Scopes:  scopes,
+		Claims:  map[string]interface{}{defaultSubjectClaim: k.Subject},
+	}, nil
+}
+
+func newJWTProvider(a Authenticator) (*jwtProvider, error) {
+	if a.SecretFile == "" && a.JWKSFile == "" {
+		return nil, fmt.Errorf("jwt authenticator needs a secret-file or a jwks-file")
+	}
+
+	p := &jwtProvider{
+		verifier:     tokenVerifier{issuer: a.Issuer, audience: a.Audience, now: time.Now},
+		subjectClaim: a.SubjectClaim,
+		scopeClaim:   a.ScopeClaim,
+		claimScopes:  a.ClaimScopes,
+	}
+	if p.subjectClaim == "" {
+		p.subjectClaim = defaultSubjectClaim
+	}
+	if p.scopeClaim == "" {
+		p.scopeClaim = defaultScopeClaim
+	}
+
+	if a.SecretFile != "" {
+		secret, err := ioutil.ReadFile(a.SecretFile)
+		if err != nil {
+			return nil, err
+		}
+		if secret = bytes.TrimSpace(secret); len(secret) == 0 {
+			return nil, fmt.Errorf("secret-file %s is empty", a.SecretFile)
+		}
+		p.verifier.secret = secret
+	}
+
+	if a.JWKSFile != "" {
+		keys, err := loadJWKS(a.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		p.verifier.keys = keys
+	}
+
+	return p, nil
+}
+
+func (p *jwtProvider) credentialsHeader() string {
+	return headerAuthorization
+}
+
+func (p *jwtProvider) authenticate(r *http.Request) (Identity, error) {
+	authorization := r.Header.Get(headerAuthorization)
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return Identity{}, errNoCredentials
+	}
+
+	claims, err := p.verifier.verify(strings.TrimPrefix(authorization, "Bearer "))
+	if err != nil {
+		return Identity{}, err
+	}
+
+	subject := claimString(claims[p.subjectClaim])
+	if subject == "" {
+		return Identity{}, fmt.Errorf("token has no %s claim", p.subjectClaim)
+	}
+
+	scopes := map[string]bool{}
+	for _, s := range claimValues(claims[p.scopeClaim]) {
+		scopes[s] = true
+	}
+	for claim, values := range p.claimScopes {
+		for _, value := range claimValues(claims[claim]) {
+			for _, s := range values[value] {
+				scopes[s] = true
+			}
+		}
+	}
+
+	return Identity{Subject: subject, Scopes: scopes, Claims: claims}, nil
+}
+
+// newIdentityProviders builds the authenticators of config, the ones that cannot be built are left out
+// so that the routes using them reject every request
+func newIdentityProviders(config Config) map[string]identityProvider {
+	providers := map[string]identityProvider{}
+	for name, a := range config.Authenticators {
+		p, err := newIdentityProvider(a)
+		if err != nil {
+			log.Error().Err(err).Str("authenticator", name).Msg("could not load authenticator, its routes reject every request")
+			continue
+		}
+		providers[name] = p
+	}
+	return providers
+}
+
+// authenticate only passes the requests allowed by auth to next, with the subject of the caller in
+// common.SubjectHeader instead of the credentials. Requests without valid credentials get a 401, the others a 403.
+func authenticate(auth RouteAuth, all map[string]identityProvider, next http.HandlerFunc) http.HandlerFunc {
+	providers := []identityProvider{}
+	for _, name := range auth.Authenticators {
+		if p, ok := all[name]; ok {
+			providers = append(providers, p)
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		traceID := common.ExtractTraceIDFromReq(r)
+
+		identity, err := identify(providers, r)
+		if err != nil {
+			log.Warn().Err(err).Str(logTraceID, traceID).Msg("request not authenticated")
+			w.Header().Set(headerWWWAuthenticate, "Bearer")
+			writeError(w, http.StatusUnauthorized, CodeUnauthorized, err.Error(), traceID)
+			return
+		}
+
+		for _, scope := range auth.Scopes {
+			if !identity.Scopes[scope] {
+				log.Warn().Str(logTraceID, traceID).Str("subject", identity.Subject).Str("scope", scope).Msg("missing scope")
+				writeError(w, http.StatusForbidden, CodeForbidden, fmt.Sprintf("scope %s is required", scope), traceID)
+				return
+			}
+		}
+
+		vars := mux.Vars(r)
+		for variable, claim := range auth.Bind {
+			if value := claimString(identity.Claims[claim]); value == "" || value != vars[variable] {
+				log.Warn().Str(logTraceID, traceID).Str("subject", identity.Subject).Str("variable", variable).
+					Msg("path variable does not match the caller")
+				writeError(w, http.StatusForbidden, CodeForbidden, fmt.Sprintf("{%s} does not belong to the caller", variable), traceID)
+				return
+			}
+		}
+
+		// Upstreams trust the subject, they have no use for the credentials of the caller
+		for _, p := range providers {
+			r.Header.Del(p.credentialsHeader())
+		}
+		r.Header.Set(common.SubjectHeader, identity.Subject)
+		next(w, r)
+	}
+}
+
+// identify returns the identity given by the first provider the request has credentials for
+func identify(providers []identityProvider, r *http.Request) (Identity, error) {
+	for _, p := range providers {
+		identity, err := p.authenticate(r)
+		if err == errNoCredentials {
+			continue
+		}
+		return identity, err
+	}
+	return Identity{}, errors.New("missing credentials")
+}
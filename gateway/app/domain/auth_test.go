@@ -0,0 +1,327 @@
+package domain
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+)
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hs256Token(t *testing.T, secret []byte, claims map[string]interface{}) string {
+	signed := encodeSegment(t, map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + encodeSegment(t, claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func rs256Token(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signed := encodeSegment(t, map[string]string{"alg": "RS256", "kid": kid}) + "." + encodeSegment(t, claims)
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestAuthentication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	secret := []byte("driver-app-secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := encodeJWKS(t, "ops-1", &rsaKey.PublicKey)
+
+	config := Config{
+		Authenticators: map[string]Authenticator{
+			"drivers": {
+				Type:        AuthJWT,
+				SecretFile:  write("secret", string(secret)+"\n"),
+				ClaimScopes: map[string]map[string][]string{"role": {"driver": {"locations:write"}}},
+			},
+			"ops": {Type: AuthJWT, JWKSFile: write("jwks.json", jwks), Issuer: "ops"},
+			"partners": {
+				Type:     AuthAPIKey,
+				KeysFile: write("keys.yaml", "keys:\n  - key: partner-key\n    subject: partner-1\n    scopes: [locations:write]\n"),
+			},
+		},
+		Urls: []URL{
+			{
+				Method: "PATCH",
+				Path:   "/drivers/{id}/locations",
+				Nsq:    &Topic{Topic: "locations"},
+				Auth: &RouteAuth{
+					Authenticators: []string{"drivers", "partners"},
+					Scopes:         []string{"locations:write"},
+					Bind:           map[string]string{"id": "sub"},
+				},
+			},
+			{
+				Method: "GET",
+				Path:   "/drivers/{id}",
+				HTTP:   &HTTP{Host: "zombie-driver"},
+				Auth:   &RouteAuth{Authenticators: []string{"ops", "partners"}},
+			},
+		},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	subjects := make(chan string, 1)
+	client, close := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" || r.Header.Get(DefaultAPIKeyHeader) != "" {
+			t.Error("upstream got the credentials of the caller")
+		}
+		subjects <- r.Header.Get(common.SubjectHeader)
+	}))
+	defer close()
+
+	m := &MockQueue{Queue: map[string][][]byte{}}
+	r, _ := NewRequestHandler(m, client, mux.NewRouter())
+	r.Gateway(config)
+
+	expiry := time.Now().Add(time.Hour).Unix()
+	driver := map[string]interface{}{"sub": "6", "role": "driver", "exp": expiry}
+
+	tests := []struct {
+		name            string
+		method          string
+		path            string
+		headers         map[string]string
+		expectedCode    int
+		expectedSubject string
+	}{
+		{
+			name:         "no credentials",
+			method:       "PATCH",
+			path:         "/drivers/6/locations",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:            "driver updates its own locations",
+			method:          "PATCH",
+			path:            "/drivers/6/locations",
+			headers:         map[string]string{"Authorization": "Bearer " + hs256Token(t, secret, driver)},
+			expectedCode:    http.StatusAccepted,
+			expectedSubject: "6",
+		},
+		{
+			name:         "driver updates another driver's locations",
+			method:       "PATCH",
+			path:         "/drivers/7/locations",
+			headers:      map[string]string{"Authorization": "Bearer " + hs256Token(t, secret, driver)},
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:   "missing scope",
+			method: "PATCH",
+			path:   "/drivers/6/locations",
+			headers: map[string]string{"Authorization": "Bearer " + hs256Token(t, secret,
+				map[string]interface{}{"sub": "6", "role": "rider", "exp": expiry})},
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:   "expired token",
+			method: "PATCH",
+			path:   "/drivers/6/locations",
+			headers: map[string]string{"Authorization": "Bearer " + hs256Token(t, secret,
+				map[string]interface{}{"sub": "6", "role": "driver", "exp": time.Now().Add(-time.Minute).Unix()})},
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:   "expiry that is not a date",
+			method: "PATCH",
+			path:   "/drivers/6/locations",
+			headers: map[string]string{"Authorization": "Bearer " + hs256Token(t, secret,
+				map[string]interface{}{"sub": "6", "role": "driver", "exp": "tomorrow"})},
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:   "not before that is not a date",
+			method: "PATCH",
+			path:   "/drivers/6/locations",
+			headers: map[string]string{"Authorization": "Bearer " + hs256Token(t, secret,
+				map[string]interface{}{"sub": "6", "role": "driver", "exp": expiry, "nbf": "yesterday"})},
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "wrong secret",
+			method:       "PATCH",
+			path:         "/drivers/6/locations",
+			headers:      map[string]string{"Authorization": "Bearer " + hs256Token(t, []byte("guessed"), driver)},
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:   "unsigned token",
+			method: "PATCH",
+			path:   "/drivers/6/locations",
+			headers: map[string]string{"Authorization": "Bearer " + encodeSegment(t, map[string]string{"alg": "none"}) +
+				"." + encodeSegment(t, driver) + "."},
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "unknown API key",
+			method:       "PATCH",
+			path:         "/drivers/partner-1/locations",
+			headers:      map[string]string{DefaultAPIKeyHeader: "guessed"},
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:            "API key",
+			method:          "PATCH",
+			path:            "/drivers/partner-1/locations",
+			headers:         map[string]string{DefaultAPIKeyHeader: "partner-key"},
+			expectedCode:    http.StatusAccepted,
+			expectedSubject: "partner-1",
+		},
+		{
+			name:   "RS256 token",
+			method: "GET",
+			path:   "/drivers/6",
+			headers: map[string]string{
+				"Authorization":      "Bearer " + rs256Token(t, rsaKey, "ops-1", map[string]interface{}{"sub": "ops-7", "iss": "ops"}),
+				common.SubjectHeader: "spoofed",
+			},
+			expectedCode:    http.StatusOK,
+			expectedSubject: "ops-7",
+		},
+		{
+			name:            "API key on a proxied route",
+			method:          "GET",
+			path:            "/drivers/6",
+			headers:         map[string]string{DefaultAPIKeyHeader: "partner-key"},
+			expectedCode:    http.StatusOK,
+			expectedSubject: "partner-1",
+		},
+		{
+			name:   "RS256 token of another issuer",
+			method: "GET",
+			path:   "/drivers/6",
+			headers: map[string]string{
+				"Authorization": "Bearer " + rs256Token(t, rsaKey, "ops-1", map[string]interface{}{"sub": "ops-7", "iss": "other"}),
+			},
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "HS256 token on a RS256 route",
+			method:       "GET",
+			path:         "/drivers/6",
+			headers:      map[string]string{"Authorization": "Bearer " + hs256Token(t, secret, driver)},
+			expectedCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m.Queue = map[string][][]byte{}
+
+			req, _ := http.NewRequest(test.method, test.path, bytes.NewReader([]byte(`{}`)))
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+
+			if rr.Code != test.expectedCode {
+				t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, test.expectedCode, rr.Body.String())
+			}
+
+			switch {
+			case test.method == "GET" && test.expectedCode == http.StatusOK:
+				if subject := <-subjects; subject != test.expectedSubject {
+					t.Errorf("upstream got subject %q, want %q", subject, test.expectedSubject)
+				}
+			case test.expectedCode == http.StatusAccepted:
+				if len(m.Queue["locations"]) != 1 {
+					t.Error("message was not published")
+				}
+			default:
+				if len(m.Queue["locations"]) != 0 {
+					t.Error("rejected message was published")
+				}
+			}
+		})
+	}
+}
+
+func encodeJWKS(t *testing.T, kid string, key *rsa.PublicKey) string {
+	return `{"keys":[{"kty":"RSA","kid":"` + kid + `","n":"` + base64.RawURLEncoding.EncodeToString(key.N.Bytes()) +
+		`","e":"` + base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()) + `"}]}`
+}
+
+func TestConfigValidateAuth(t *testing.T) {
+	f, err := ioutil.TempFile("", "keys*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("keys:\n  - key: partner-key\n    subject: partner-1\n")
+	f.Close()
+
+	tests := []struct {
+		name string
+		auth RouteAuth
+	}{
+		{name: "unknown authenticator", auth: RouteAuth{Authenticators: []string{"unknown"}}},
+		{name: "no authenticator", auth: RouteAuth{}},
+		{name: "unknown bound variable", auth: RouteAuth{Authenticators: []string{"partners"}, Bind: map[string]string{"driver": "sub"}}},
+	}
+
+	for _, test := range tests {
+		config := Config{
+			Authenticators: map[string]Authenticator{"partners": {Type: AuthAPIKey, KeysFile: f.Name()}},
+			Urls:           []URL{{Method: "GET", Path: "/drivers/{id}", HTTP: &HTTP{Host: "zombie-driver"}, Auth: &test.auth}},
+		}
+		if err := config.Validate(); err == nil {
+			t.Errorf("%s: was expecting an error", test.name)
+		}
+	}
+
+	valid := Config{
+		Authenticators: map[string]Authenticator{"partners": {Type: AuthAPIKey, KeysFile: f.Name()}},
+		Urls: []URL{{Method: "GET", Path: "/drivers/{id}", HTTP: &HTTP{Host: "zombie-driver"},
+			Auth: &RouteAuth{Authenticators: []string{"partners"}, Bind: map[string]string{"id": "sub"}}}},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Error(err)
+	}
+}
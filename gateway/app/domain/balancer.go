@@ -0,0 +1,261 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrNoUpstream is returned when every upstream of a route is unhealthy or ejected
+var ErrNoUpstream = errors.New("no healthy upstream")
+
+const (
+	// virtualNodes is the number of points each upstream has on the consistent hash ring,
+	// more points spread the keys more evenly
+	virtualNodes = 100
+
+	defaultHealthCheckTimeout = time.Second
+	defaultHealthyThreshold   = 1
+	defaultUnhealthyThreshold = 2
+)
+
+// upstream is a host of a route along with its health
+type upstream struct {
+	host string
+
+	// active is the number of requests in progress
+	active int64
+	// consecutiveErrors counts 5xx responses and errors in a row for outlier detection
+	consecutiveErrors int64
+	// ejectedUntil is when an ejected upstream gets requests again, as unix nanoseconds
+	ejectedUntil int64
+
+	// healthy is updated by the active health checks
+	mu        sync.Mutex
+	healthy   bool
+	successes int
+	failures  int
+}
+
+func (u *upstream) available(now time.Time) bool {
+	u.mu.Lock()
+	healthy := u.healthy
+	u.mu.Unlock()
+
+	return healthy && now.UnixNano() >= atomic.LoadInt64(&u.ejectedUntil)
+}
+
+// ringPoint is a point of the consistent hash ring
+type ringPoint struct {
+	hash     uint32
+	upstream *upstream
+}
+
+// Balancer picks the upstream of each request of an http route
+type Balancer struct {
+	upstreams   []*upstream
+	strategy    string
+	hashKey     string
+	healthCheck *HealthCheck
+	outlier     *OutlierDetection
+
+	next uint64
+	ring []ringPoint
+	now  func() time.Time
+}
+
+func NewBalancer(h HTTP) *Balancer {
+	b := &Balancer{
+		strategy:    h.LoadBalancing(),
+		hashKey:     h.HashVariable(),
+		healthCheck: h.HealthCheck,
+		outlier:     h.Outlier,
+		now:         time.Now,
+	}
+
+	for _, host := range h.Upstreams() {
+		u := &upstream{host: host, healthy: true}
+		b.upstreams = append(b.upstreams, u)
+
+		for i := 0; i < virtualNodes; i++ {
+			b.ring = append(b.ring, ringPoint{hash: crc32.ChecksumIEEE([]byte(host + "#" + strconv.Itoa(i))), upstream: u})
+		}
+	}
+
+	sort.Slice(b.ring, func(i, j int) bool {
+		return b.ring[i].hash < b.ring[j].hash
+	})
+
+	return b
+}
+
+// Pick returns the upstream that should serve r, Done must be called once the request is over
+func (b *Balancer) Pick(r *http.Request) (*upstream, error) {
+	now := b.now()
+
+	var picked *upstream
+	switch b.strategy {
+	case StrategyConsistentHash:
+		picked = b.pickHash(mux.Vars(r)[b.hashKey], now)
+	case StrategyLeastConnections:
+		picked = b.pickLeastConnections(now)
+	default:
+		picked = b.pickRoundRobin(now)
+	}
+
+	if picked == nil {
+		return nil, ErrNoUpstream
+	}
+
+	atomic.AddInt64(&picked.active, 1)
+	return picked, nil
+}
+
+// Release ends a request sent to u whose outcome says nothing about it, e.g the client went away
+// or the request ran out of time
+func (b *Balancer) Release(u *upstream) {
+	atomic.AddInt64(&u.active, -1)
+}
+
+// Done reports the outcome of a request sent to u, status is ignored when err is not nil
+func (b *Balancer) Done(u *upstream, status int, err error) {
+	atomic.AddInt64(&u.active, -1)
+
+	if b.outlier == nil {
+		return
+	}
+
+	if err == nil && status < http.StatusInternalServerError {
+		atomic.StoreInt64(&u.consecutiveErrors, 0)
+		return
+	}
+
+	if atomic.AddInt64(&u.consecutiveErrors, 1) >= int64(b.outlier.Consecutive5xx) {
+		atomic.StoreInt64(&u.consecutiveErrors, 0)
+		atomic.StoreInt64(&u.ejectedUntil, b.now().Add(b.outlier.EjectionTime).UnixNano())
+		log.Warn().Str("host", u.host).Dur("ejection", b.outlier.EjectionTime).Msg("upstream ejected after consecutive errors")
+	}
+}
+
+func (b *Balancer) pickRoundRobin(now time.Time) *upstream {
+	n := uint64(len(b.upstreams))
+	start := atomic.AddUint64(&b.next, 1)
+
+	for i := uint64(0); i < n; i++ {
+		if u := b.upstreams[(start+i)%n]; u.available(now) {
+			return u
+		}
+	}
+	return nil
+}
+
+func (b *Balancer) pickLeastConnections(now time.Time) *upstream {
+	var picked *upstream
+	for _, u := range b.upstreams {
+		if !u.available(now) {
+			continue
+		}
+		if picked == nil || atomic.LoadInt64(&u.active) < atomic.LoadInt64(&picked.active) {
+			picked = u
+		}
+	}
+	return picked
+}
+
+// pickHash walks the ring clockwise from the hash of key to the first available upstream,
+// so a key only moves to another upstream while its own is unavailable
+func (b *Balancer) pickHash(key string, now time.Time) *upstream {
+	if len(b.ring) == 0 {
+		return nil
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(b.ring), func(i int) bool {
+		return b.ring[i].hash >= hash
+	})
+
+	for i := 0; i < len(b.ring); i++ {
+		if u := b.ring[(start+i)%len(b.ring)].upstream; u.available(now) {
+			return u
+		}
+	}
+	return nil
+}
+
+// HealthCheck probes every upstream until ctx is cancelled, it returns straight away
+// when the route has no health check
+func (b *Balancer) HealthCheck(ctx context.Context, client *http.Client) {
+	if b.healthCheck == nil {
+		return
+	}
+
+	ticker := time.NewTicker(b.healthCheck.Interval)
+	defer ticker.Stop()
+
+	for {
+		for _, u := range b.upstreams {
+			b.check(ctx, client, u)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *Balancer) check(ctx context.Context, client *http.Client, u *upstream) {
+	timeout := b.healthCheck.Timeout
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ok := false
+	req, err := http.NewRequest(http.MethodGet, upstreamURL(u.host, b.healthCheck.Path), nil)
+	if err == nil {
+		res, err := client.Do(req.WithContext(ctx))
+		if err == nil {
+			ok = res.StatusCode >= 200 && res.StatusCode < 300
+			res.Body.Close()
+		}
+	}
+
+	healthyThreshold, unhealthyThreshold := b.healthCheck.HealthyThreshold, b.healthCheck.UnhealthyThreshold
+	if healthyThreshold <= 0 {
+		healthyThreshold = defaultHealthyThreshold
+	}
+	if unhealthyThreshold <= 0 {
+		unhealthyThreshold = defaultUnhealthyThreshold
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if ok {
+		u.successes, u.failures = u.successes+1, 0
+		if !u.healthy && u.successes >= healthyThreshold {
+			u.healthy = true
+			log.Info().Str("host", u.host).Msg("upstream is healthy again")
+		}
+		return
+	}
+
+	u.successes, u.failures = 0, u.failures+1
+	if u.healthy && u.failures >= unhealthyThreshold {
+		u.healthy = false
+		log.Warn().Str("host", u.host).Msg("upstream failed its health checks")
+	}
+}
@@ -0,0 +1,194 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func requestWithID(id string) *http.Request {
+	req, _ := http.NewRequest("GET", "/drivers/"+id, nil)
+	return mux.SetURLVars(req, map[string]string{"id": id})
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b := NewBalancer(HTTP{Hosts: []string{"a", "b", "c"}})
+
+	counts := map[string]int{}
+	for i := 0; i < 30; i++ {
+		u, err := b.Pick(requestWithID("1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[u.host]++
+		b.Done(u, http.StatusOK, nil)
+	}
+
+	for _, host := range []string{"a", "b", "c"} {
+		if counts[host] != 10 {
+			t.Errorf("host %s got %d requests, want 10", host, counts[host])
+		}
+	}
+}
+
+func TestBalancerLeastConnections(t *testing.T) {
+	b := NewBalancer(HTTP{Hosts: []string{"a", "b"}, Strategy: StrategyLeastConnections})
+
+	first, _ := b.Pick(requestWithID("1"))
+	second, _ := b.Pick(requestWithID("1"))
+	if first == second {
+		t.Fatalf("both requests went to %s while the other host was idle", first.host)
+	}
+
+	b.Done(first, http.StatusOK, nil)
+	third, _ := b.Pick(requestWithID("1"))
+	if third != first {
+		t.Errorf("got %s, want the idle host %s", third.host, first.host)
+	}
+}
+
+func TestBalancerConsistentHash(t *testing.T) {
+	b := NewBalancer(HTTP{Hosts: []string{"a", "b", "c"}, Strategy: StrategyConsistentHash, HashKey: "{id}"})
+
+	picked := map[string]string{}
+	for _, id := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+		u, _ := b.Pick(requestWithID(id))
+		picked[id] = u.host
+		b.Done(u, http.StatusOK, nil)
+	}
+
+	for i := 0; i < 5; i++ {
+		for id, host := range picked {
+			u, _ := b.Pick(requestWithID(id))
+			if u.host != host {
+				t.Errorf("driver %s moved from %s to %s", id, host, u.host)
+			}
+			b.Done(u, http.StatusOK, nil)
+		}
+	}
+}
+
+func TestBalancerOutlierEjection(t *testing.T) {
+	b := NewBalancer(HTTP{
+		Hosts:   []string{"a", "b"},
+		Outlier: &OutlierDetection{Consecutive5xx: 2, EjectionTime: time.Minute},
+	})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	var a *upstream
+	for a == nil || a.host != "a" {
+		u, _ := b.Pick(requestWithID("1"))
+		b.Done(u, http.StatusOK, nil)
+		a = u
+	}
+
+	b.Done(a, http.StatusInternalServerError, nil)
+	atomic.AddInt64(&a.active, 1)
+	b.Done(a, 0, errors.New("connection refused"))
+
+	for i := 0; i < 4; i++ {
+		u, _ := b.Pick(requestWithID("1"))
+		if u.host != "b" {
+			t.Errorf("ejected host %s still gets requests", u.host)
+		}
+		b.Done(u, http.StatusOK, nil)
+	}
+
+	now = now.Add(time.Minute)
+	counts := map[string]int{}
+	for i := 0; i < 4; i++ {
+		u, _ := b.Pick(requestWithID("1"))
+		counts[u.host]++
+		b.Done(u, http.StatusOK, nil)
+	}
+	if counts["a"] == 0 {
+		t.Error("host was not brought back after its ejection time")
+	}
+}
+
+// test that requests cancelled by the client or timing out do not eject a healthy upstream
+func TestBalancerClientCancel(t *testing.T) {
+	client, close := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("hang") != "" {
+			<-r.Context().Done()
+		}
+	}))
+	defer close()
+
+	r, _ := NewRequestHandler(&MockQueue{Queue: map[string][][]byte{}}, client, mux.NewRouter())
+	r.Gateway(Config{
+		Urls: []URL{
+			{Method: "GET", Path: "/drivers/{id}", HTTP: &HTTP{Host: "zombie-driver", Timeout: 50 * time.Millisecond,
+				Outlier: &OutlierDetection{Consecutive5xx: 1, EjectionTime: time.Minute}}},
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		// The client goes away while the upstream is still working on the request
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(5*time.Millisecond, cancel)
+
+		req, _ := http.NewRequest("GET", "/drivers/1?hang=1", nil)
+		r.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+	}
+
+	// The route timeout fires
+	req, _ := http.NewRequest("GET", "/drivers/1?hang=1", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusGatewayTimeout)
+	}
+
+	req, _ = http.NewRequest("GET", "/drivers/1", nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("upstream was ejected, got %v (%s)", rr.Code, rr.Body.String())
+	}
+}
+
+func TestBalancerHealthCheck(t *testing.T) {
+	var healthy int32 = 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	b := NewBalancer(HTTP{
+		Host:        strings.TrimPrefix(ts.URL, "http://"),
+		HealthCheck: &HealthCheck{Path: "/health", Interval: time.Second, UnhealthyThreshold: 2},
+	})
+	u := b.upstreams[0]
+	ctx := context.Background()
+
+	atomic.StoreInt32(&healthy, 0)
+	b.check(ctx, ts.Client(), u)
+	if _, err := b.Pick(requestWithID("1")); err != nil {
+		t.Fatalf("host is unhealthy after a single failed check: %v", err)
+	}
+	b.Done(u, http.StatusOK, nil)
+
+	b.check(ctx, ts.Client(), u)
+	if _, err := b.Pick(requestWithID("1")); err != ErrNoUpstream {
+		t.Fatalf("got %v, want %v", err, ErrNoUpstream)
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	b.check(ctx, ts.Client(), u)
+	if _, err := b.Pick(requestWithID("1")); err != nil {
+		t.Errorf("host is still unhealthy after a successful check: %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/rs/zerolog/log"
+)
+
+// States of a circuit breaker
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+const defaultHalfOpenRequests = 1
+
+// OpenError is returned instead of calling a backend whose breaker is open
+type OpenError struct {
+	Route string
+	// RetryAfter is how long until the breaker lets a probe through
+	RetryAfter time.Duration
+}
+
+func (o OpenError) Error() string {
+	return fmt.Sprintf("circuit breaker of %s is open", o.Route)
+}
+
+// RetryAfterSeconds returns RetryAfter rounded up to a whole number of seconds, at least 1
+func (o OpenError) RetryAfterSeconds() int {
+	seconds := int(math.Ceil(o.RetryAfter.Seconds()))
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// BreakerState is a snapshot of a breaker, as returned by the admin API
+type BreakerState struct {
+	Route    string `json:"route"`
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	// Trips is how many times the breaker opened
+	Trips uint64 `json:"trips"`
+	// Rejected is how many calls failed fast while the breaker was open
+	Rejected uint64 `json:"rejected"`
+	// OpenUntil is when an open breaker lets probes through
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+}
+
+// Breaker stops calling a backend after FailureThreshold failures in a row. Once open it
+// rejects every call for OpenDuration, then lets HalfOpenRequests probes through: the breaker
+// closes when they all succeed and opens again as soon as one fails.
+type Breaker struct {
+	route  string
+	config CircuitBreaker
+	now    func() time.Time
+
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openedAt  time.Time
+	probes    int
+	successes int
+	trips     uint64
+	rejected  uint64
+	// generation changes with every state, the outcome of a call admitted in another one is ignored
+	generation uint64
+}
+
+func NewBreaker(route string, config CircuitBreaker) *Breaker {
+	return &Breaker{route: route, config: config.withDefaults(), state: BreakerClosed, now: time.Now}
+}
+
+// withDefaults returns the config with its unset fields defaulted, as used by a breaker
+func (c CircuitBreaker) withDefaults() CircuitBreaker {
+	if c.HalfOpenRequests <= 0 {
+		c.HalfOpenRequests = defaultHalfOpenRequests
+	}
+	return c
+}
+
+// Allow returns an OpenError when the call must not be made, otherwise Done must be called
+// with its outcome and the generation returned along with it
+func (b *Breaker) Allow() (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen {
+		openUntil := b.openedAt.Add(b.config.OpenDuration)
+		if b.now().Before(openUntil) {
+			b.reject()
+			return 0, OpenError{Route: b.route, RetryAfter: openUntil.Sub(b.now())}
+		}
+		b.setState(BreakerHalfOpen)
+	}
+
+	if b.state == BreakerHalfOpen {
+		if b.probes >= b.config.HalfOpenRequests {
+			b.reject()
+			return 0, OpenError{Route: b.route, RetryAfter: b.config.OpenDuration}
+		}
+		b.probes++
+	}
+
+	return b.generation, nil
+}
+
+// Done reports the outcome of a call let through by Allow in generation. A slow call admitted
+// before the breaker changed state says nothing about the new one, e.g it is not a probe.
+func (b *Breaker) Done(generation uint64, success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	switch b.state {
+	case BreakerHalfOpen:
+		if !success {
+			b.open()
+			return
+		}
+		b.successes++
+		if b.successes >= b.config.HalfOpenRequests {
+			b.setState(BreakerClosed)
+		}
+
+	case BreakerClosed:
+		if success {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.config.FailureThreshold {
+			b.open()
+		}
+	}
+}
+
+// Release gives back a call let through by Allow whose outcome says nothing about the backend,
+// e.g the client went away before it answered
+func (b *Breaker) Release(generation uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation == b.generation && b.state == BreakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// State returns a snapshot of the breaker
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := BreakerState{Route: b.route, State: b.state, Failures: b.failures, Trips: b.trips, Rejected: b.rejected}
+	if b.state == BreakerOpen {
+		openUntil := b.openedAt.Add(b.config.OpenDuration)
+		s.OpenUntil = &openUntil
+	}
+	return s
+}
+
+func (b *Breaker) reject() {
+	b.rejected++
+	breakerRejected.WithLabelValues(b.route).Inc()
+}
+
+func (b *Breaker) open() {
+	b.trips++
+	breakerTrips.WithLabelValues(b.route).Inc()
+	b.openedAt = b.now()
+	b.setState(BreakerOpen)
+}
+
+// setState resets the counters of the previous state, mu must be held
+func (b *Breaker) setState(state string) {
+	log.Warn().Str("route", b.route).Str("from", b.state).Str("to", state).Msg("circuit breaker state changed")
+
+	b.state = state
+	b.generation++
+	breakerState.WithLabelValues(b.route).Set(breakerStateValues[state])
+	b.failures, b.probes, b.successes = 0, 0, 0
+}
+
+// breakerSender guards a producer with a breaker, so that an unreachable queue fails fast
+type breakerSender struct {
+	sender  common.Sender
+	breaker *Breaker
+}
+
+func (b breakerSender) Send(ctx context.Context, topic, key, msg string) error {
+	generation, err := b.breaker.Allow()
+	if err != nil {
+		return err
+	}
+
+	err = b.sender.Send(ctx, topic, key, msg)
+	if errors.Is(err, context.Canceled) {
+		b.breaker.Release(generation)
+		return err
+	}
+	b.breaker.Done(generation, err == nil)
+	return err
+}
@@ -0,0 +1,241 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBreaker(t *testing.T) {
+	b := NewBreaker("GET /drivers/{id}", CircuitBreaker{FailureThreshold: 2, OpenDuration: 10 * time.Second, HalfOpenRequests: 2})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	call := func(success bool) error {
+		generation, err := b.Allow()
+		if err != nil {
+			return err
+		}
+		b.Done(generation, success)
+		return nil
+	}
+
+	// A success resets the failures
+	call(false)
+	call(true)
+	call(false)
+	if state := b.State().State; state != BreakerClosed {
+		t.Fatalf("got state %s, want %s", state, BreakerClosed)
+	}
+
+	call(false)
+	if state := b.State().State; state != BreakerOpen {
+		t.Fatalf("got state %s, want %s", state, BreakerOpen)
+	}
+
+	now = now.Add(4 * time.Second)
+	var open OpenError
+	if err := call(true); !errors.As(err, &open) {
+		t.Fatalf("was expecting an open breaker error, got %v", err)
+	}
+	if open.RetryAfterSeconds() != 6 {
+		t.Errorf("got Retry-After %d, want 6", open.RetryAfterSeconds())
+	}
+
+	// A failed probe opens the breaker again
+	now = now.Add(6 * time.Second)
+	if err := call(false); err != nil {
+		t.Fatal(err)
+	}
+	if state := b.State().State; state != BreakerOpen {
+		t.Fatalf("got state %s, want %s", state, BreakerOpen)
+	}
+
+	// The breaker closes once every probe succeeded
+	now = now.Add(10 * time.Second)
+	call(true)
+	if state := b.State().State; state != BreakerHalfOpen {
+		t.Fatalf("got state %s, want %s", state, BreakerHalfOpen)
+	}
+	call(true)
+
+	state := b.State()
+	if state.State != BreakerClosed || state.Trips != 2 || state.Rejected != 1 {
+		t.Errorf("unexpected breaker state %+v", state)
+	}
+}
+
+func TestBreakerHalfOpenProbes(t *testing.T) {
+	b := NewBreaker("GET /drivers/{id}", CircuitBreaker{FailureThreshold: 1, OpenDuration: time.Second})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	generation, _ := b.Allow()
+	b.Done(generation, false)
+	now = now.Add(time.Second)
+
+	if _, err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	// Only one probe at a time while half-open
+	if _, err := b.Allow(); err == nil {
+		t.Error("was expecting the second probe to be rejected")
+	}
+}
+
+// test that an open breaker fails fast with a Retry-After on both kinds of routes
+func TestCircuitBreakerOpen(t *testing.T) {
+	calls := 0
+	client, close := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer close()
+
+	m := &MockQueue{Queue: map[string][][]byte{}, Err: errors.New("broker is down")}
+	r, _ := NewRequestHandler(m, client, mux.NewRouter())
+
+	breaker := &CircuitBreaker{FailureThreshold: 1, OpenDuration: time.Minute}
+	r.Gateway(Config{
+		Urls: []URL{
+			{Method: "PATCH", Path: "/drivers/{id}/locations", Nsq: &Topic{Topic: "locations"}, Breaker: breaker},
+			{Method: "GET", Path: "/drivers/{id}", HTTP: &HTTP{Host: "zombie-driver"}, Breaker: breaker},
+		},
+	})
+
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{method: "PATCH", path: "/drivers/1/locations"},
+		{method: "GET", path: "/drivers/1"},
+	}
+
+	for _, test := range tests {
+		for i, expectedRetryAfter := range []string{"", "60"} {
+			req, _ := http.NewRequest(test.method, test.path, bytes.NewReader([]byte(`{}`)))
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+
+			if retryAfter := rr.Header().Get(headerRetryAfter); retryAfter != expectedRetryAfter {
+				t.Errorf("%s %s call %d: got Retry-After %q want %q", test.method, test.path, i, retryAfter, expectedRetryAfter)
+			}
+		}
+	}
+
+	if calls != 1 || len(m.Queue["locations"]) != 0 {
+		t.Errorf("backends were called while the breakers were open")
+	}
+
+	for _, state := range r.Breakers() {
+		if state.State != BreakerOpen || state.Rejected != 1 {
+			t.Errorf("unexpected breaker state %+v", state)
+		}
+	}
+
+	// A reload that leaves the breaker config alone keeps its state
+	if err := r.Reload(r.GetConfig()); err != nil {
+		t.Fatal(err)
+	}
+	for _, state := range r.Breakers() {
+		if state.State != BreakerOpen {
+			t.Errorf("breaker of %s was reset by the reload", state.Route)
+		}
+		if value := testutil.ToFloat64(breakerState.WithLabelValues(state.Route)); value != breakerStateValues[BreakerOpen] {
+			t.Errorf("state gauge of %s was reset by the reload to %v", state.Route, value)
+		}
+	}
+}
+
+// test that clients hanging up do not open the breaker of a healthy upstream
+func TestCircuitBreakerClientCancel(t *testing.T) {
+	client, close := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer close()
+
+	r, _ := NewRequestHandler(&MockQueue{Queue: map[string][][]byte{}}, client, mux.NewRouter())
+	r.Gateway(Config{
+		Urls: []URL{
+			{Method: "GET", Path: "/drivers/{id}", HTTP: &HTTP{Host: "zombie-driver"},
+				Breaker: &CircuitBreaker{FailureThreshold: 1, OpenDuration: time.Minute}},
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		// The client goes away while the upstream is still working on the request
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(5*time.Millisecond, cancel)
+
+		req, _ := http.NewRequest("GET", "/drivers/1", nil)
+		r.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+	}
+
+	for _, state := range r.Breakers() {
+		if state.State != BreakerClosed || state.Failures != 0 {
+			t.Errorf("was expecting cancelled requests not to count as failures, got %+v", state)
+		}
+	}
+}
+
+func TestBreakerRelease(t *testing.T) {
+	b := NewBreaker("GET /drivers/{id}", CircuitBreaker{FailureThreshold: 1, OpenDuration: time.Second})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	generation, _ := b.Allow()
+	b.Done(generation, false)
+	now = now.Add(time.Second)
+
+	// A probe whose client went away lets another probe through
+	generation, err := b.Allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Release(generation)
+	if _, err := b.Allow(); err != nil {
+		t.Errorf("was expecting a new probe once the first was released, got %v", err)
+	}
+	if state := b.State().State; state != BreakerHalfOpen {
+		t.Errorf("got state %s, want %s", state, BreakerHalfOpen)
+	}
+}
+
+// test that a slow call admitted while the breaker was closed is not taken for a probe
+func TestBreakerGenerations(t *testing.T) {
+	b := NewBreaker("GET /drivers/{id}", CircuitBreaker{FailureThreshold: 1, OpenDuration: time.Second})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	slow, _ := b.Allow()
+	failed, _ := b.Allow()
+	b.Done(failed, false)
+	now = now.Add(time.Second)
+
+	probe, err := b.Allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The slow call ends while the probe is in flight, neither its success nor its release count
+	b.Done(slow, true)
+	b.Release(slow)
+	if state := b.State().State; state != BreakerHalfOpen {
+		t.Fatalf("got state %s, want %s", state, BreakerHalfOpen)
+	}
+	if _, err := b.Allow(); err == nil {
+		t.Error("was expecting a second probe to be rejected")
+	}
+
+	b.Done(probe, true)
+	if state := b.State().State; state != BreakerClosed {
+		t.Errorf("got state %s, want %s", state, BreakerClosed)
+	}
+}
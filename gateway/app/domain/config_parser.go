@@ -1,28 +1,390 @@
 package domain
 
 import (
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
 	"gopkg.in/yaml.v2"
 )
 
+// Config is the content of the routes file, in yaml or in JSON with the same keys
 type Config struct {
-	Urls []URL `json:"urls"`
+	Urls []URL `yaml:"urls"`
+	// Authenticators identify the callers of the routes, by name
+	Authenticators map[string]Authenticator `yaml:"authenticators,omitempty"`
+}
+
+// Authenticator types
+const (
+	AuthAPIKey = "api-key"
+	AuthJWT    = "jwt"
+)
+
+// Authenticator identifies the caller of a request. An AuthAPIKey authenticator looks the key passed in Header
+// up in KeysFile. An AuthJWT authenticator checks the bearer token of the Authorization header with the HS256
+// secret of SecretFile or the RS256 keys of JWKSFile, and its Issuer and Audience when they are set.
+type Authenticator struct {
+	Type     string `yaml:"type"`
+	KeysFile string `yaml:"keys-file,omitempty"`
+	// Header carries the API key, DefaultAPIKeyHeader when not set
+	Header     string `yaml:"header,omitempty"`
+	SecretFile string `yaml:"secret-file,omitempty"`
+	JWKSFile   string `yaml:"jwks-file,omitempty"`
+	Issuer     string `yaml:"issuer,omitempty"`
+	Audience   string `yaml:"audience,omitempty"`
+	// SubjectClaim identifies the caller, `sub` when not set
+	SubjectClaim string `yaml:"subject-claim,omitempty"`
+	// ScopeClaim holds the scopes granted to the caller, `scope` when not set
+	ScopeClaim string `yaml:"scope-claim,omitempty"`
+	// ClaimScopes grants scopes by claim value, e.g `{role: {driver: [locations:write]}}`
+	ClaimScopes map[string]map[string][]string `yaml:"claim-scopes,omitempty"`
+}
+
+// RouteAuth lets a request through once one of Authenticators identified its caller, who must have every
+// scope of Scopes. Bind maps path variables to claims, e.g `{id: sub}` only lets a driver use its own {id}.
+type RouteAuth struct {
+	Authenticators []string          `yaml:"authenticators"`
+	Scopes         []string          `yaml:"scopes,omitempty"`
+	Bind           map[string]string `yaml:"bind,omitempty"`
 }
 
 type Topic struct {
-	Topic string `json:"topic"`
+	Topic string `yaml:"topic"`
+	// Key is the name of the path variable used as the message key, e.g `id` or `{id}`.
+	// Messages with the same key keep their order, so keying by driver ID keeps each driver's pings ordered.
+	Key string `yaml:"key,omitempty"`
+	// Mode is either ModeSync (the default), where the response waits for the broker acknowledgement,
+	// or ModeAsync where the message is buffered and its delivery reported later
+	Mode string `yaml:"mode,omitempty"`
+	// Policy is what happens when the message cannot be published: PolicyFailClosed (the default)
+	// answers 503, PolicyStoreAndForward stores it in the outbox until the broker recovers
+	Policy string `yaml:"policy,omitempty"`
+	// Timeout bounds the wait for the broker in ModeSync, DefaultPublishTimeout when not set. Past it
+	// the message goes to the outbox or the request fails, according to Policy.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// DefaultPublishTimeout is the publish timeout of the queue routes that do not set one
+const DefaultPublishTimeout = 2 * time.Second
+
+// PublishTimeout returns the publish timeout of the route, DefaultPublishTimeout when none is set
+func (t Topic) PublishTimeout() time.Duration {
+	if t.Timeout <= 0 {
+		return DefaultPublishTimeout
+	}
+	return t.Timeout
+}
+
+// Publish failure policies of an async route
+const (
+	PolicyFailClosed      = "fail-closed"
+	PolicyStoreAndForward = "store-and-forward"
+)
+
+// FailurePolicy returns the publish failure policy of the route, PolicyFailClosed when none is set
+func (t Topic) FailurePolicy() string {
+	if t.Policy == "" {
+		return PolicyFailClosed
+	}
+	return t.Policy
+}
+
+// Producer modes of an async route
+const (
+	ModeSync  = "sync"
+	ModeAsync = "async"
+)
+
+// ProducerMode returns the mode of the route, ModeSync when none is set
+func (t Topic) ProducerMode() string {
+	if t.Mode == "" {
+		return ModeSync
+	}
+	return t.Mode
+}
+
+// KeyVariable returns the name of the path variable used as the message key without braces
+func (t Topic) KeyVariable() string {
+	return strings.TrimSuffix(strings.TrimPrefix(t.Key, "{"), "}")
 }
 
 type HTTP struct {
-	Host string `json:"host"`
+	// Host is a host name with an optional port, the upstream is reached over https when it starts with https://
+	Host string `yaml:"host,omitempty"`
+	// Hosts spreads the requests across several upstreams, Host is used when there are none
+	Hosts []string `yaml:"hosts,omitempty"`
+	// Strategy picks the upstream of a request: StrategyRoundRobin (the default), StrategyLeastConnections
+	// or StrategyConsistentHash which sends a given value of the HashKey path variable to the same upstream
+	Strategy string `yaml:"strategy,omitempty"`
+	HashKey  string `yaml:"hash-key,omitempty"`
+	// HealthCheck actively probes the upstreams and stops sending requests to the failing ones
+	HealthCheck *HealthCheck `yaml:"health-check,omitempty"`
+	// Outlier ejects an upstream for a while after consecutive 5xx responses or errors
+	Outlier *OutlierDetection `yaml:"outlier,omitempty"`
+	// Timeout bounds the whole request, retries included, DefaultProxyTimeout when not set
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// Retry sends idempotent requests again when the upstream fails or answers a retryable status
+	Retry *Retry `yaml:"retry,omitempty"`
+	// RequestHeaders filters the client headers sent to the upstream
+	RequestHeaders *HeaderFilter `yaml:"request-headers,omitempty"`
+	// ResponseHeaders filters the upstream headers sent back to the client
+	ResponseHeaders *HeaderFilter `yaml:"response-headers,omitempty"`
+	// Target is the path of the upstream, its {variables} are the ones of the route path,
+	// e.g `/drivers/{id}` for `/v2/drivers/{id}/status`. The request path is used when it is not set.
+	Target string `yaml:"target,omitempty"`
+	// StripPrefix is removed from the request path before it is sent upstream, when there is no Target
+	StripPrefix string `yaml:"strip-prefix,omitempty"`
+	// QueryRename renames the query parameters sent upstream, from the public name to the upstream one
+	QueryRename map[string]string `yaml:"query-rename,omitempty"`
+}
+
+// pathVariable matches the {variables} of a path, with or without a pattern
+var pathVariable = regexp.MustCompile(`\{([^{}:]+)(:[^{}]*)?\}`)
+
+// pathVariables returns the names of the variables of a route path, with or without a pattern
+// such as `{id:[0-9]+}`
+func pathVariables(path string) map[string]bool {
+	variables := map[string]bool{}
+	for _, match := range pathVariable.FindAllStringSubmatch(path, -1) {
+		variables[match[1]] = true
+	}
+	return variables
+}
+
+// TargetVariables returns the names of the variables of Target
+func (h HTTP) TargetVariables() []string {
+	names := []string{}
+	for _, match := range pathVariable.FindAllStringSubmatch(h.Target, -1) {
+		names = append(names, match[1])
+	}
+	return names
+}
+
+// HeaderFilter only lets through the Allow headers when there are some, and never the Deny ones.
+// The headers set by the gateway itself, such as X-Trace-Id and X-Forwarded-*, are not filtered.
+type HeaderFilter struct {
+	Allow []string `yaml:"allow,omitempty"`
+	Deny  []string `yaml:"deny,omitempty"`
+}
+
+// DefaultProxyTimeout is the timeout of the http routes that do not set one
+const DefaultProxyTimeout = 5 * time.Second
+
+// Retry sends a request again up to Attempts times, waiting Backoff before the first retry and
+// twice as long before each next one, up to MaxBackoff. Statuses are the upstream statuses worth
+// a retry, 502, 503 and 504 when none are set.
+type Retry struct {
+	Attempts   int           `yaml:"attempts"`
+	Statuses   []int         `yaml:"statuses,omitempty"`
+	Backoff    time.Duration `yaml:"backoff,omitempty"`
+	MaxBackoff time.Duration `yaml:"max-backoff,omitempty"`
+}
+
+var defaultRetryStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// Policy returns the retry as a common.RetryPolicy
+func (r Retry) Policy() common.RetryPolicy {
+	return common.RetryPolicy{MaxRetries: r.Attempts, InitialBackoff: r.Backoff, MaxBackoff: r.MaxBackoff}
+}
+
+// Retryable reports whether a response with status is worth a retry
+func (r Retry) Retryable(status int) bool {
+	statuses := r.Statuses
+	if len(statuses) == 0 {
+		statuses = defaultRetryStatuses
+	}
+
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// ProxyTimeout returns the timeout of the route, DefaultProxyTimeout when none is set
+func (h HTTP) ProxyTimeout() time.Duration {
+	if h.Timeout <= 0 {
+		return DefaultProxyTimeout
+	}
+	return h.Timeout
+}
+
+// Load balancing strategies of an http route
+const (
+	StrategyRoundRobin       = "round-robin"
+	StrategyLeastConnections = "least-connections"
+	StrategyConsistentHash   = "consistent-hash"
+)
+
+// HealthCheck is a GET request sent to Path on every upstream every Interval. An upstream is
+// unhealthy after UnhealthyThreshold failed checks in a row and healthy again after HealthyThreshold
+// successful ones.
+type HealthCheck struct {
+	Path               string        `yaml:"path"`
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout,omitempty"`
+	UnhealthyThreshold int           `yaml:"unhealthy-threshold,omitempty"`
+	HealthyThreshold   int           `yaml:"healthy-threshold,omitempty"`
+}
+
+// OutlierDetection ejects an upstream for EjectionTime once it answered Consecutive5xx
+// 5xx responses, or failed to answer, in a row
+type OutlierDetection struct {
+	Consecutive5xx int           `yaml:"consecutive-5xx"`
+	EjectionTime   time.Duration `yaml:"ejection-time"`
+}
+
+// Upstreams returns the hosts of the route
+func (h HTTP) Upstreams() []string {
+	if len(h.Hosts) > 0 {
+		return h.Hosts
+	}
+	if h.Host != "" {
+		return []string{h.Host}
+	}
+	return nil
+}
+
+// LoadBalancing returns the strategy of the route, StrategyRoundRobin when none is set
+func (h HTTP) LoadBalancing() string {
+	if h.Strategy == "" {
+		return StrategyRoundRobin
+	}
+	return h.Strategy
+}
+
+// HashVariable returns the name of the path variable used by StrategyConsistentHash without braces
+func (h HTTP) HashVariable() string {
+	return strings.TrimSuffix(strings.TrimPrefix(h.HashKey, "{"), "}")
+}
+
+func (h HTTP) validate() error {
+	if len(h.Upstreams()) == 0 {
+		return fmt.Errorf("no host")
+	}
+
+	for _, host := range h.Upstreams() {
+		if strings.Contains(host, "://") && !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
+			return fmt.Errorf("host %s: only http and https are supported", host)
+		}
+	}
+
+	switch h.LoadBalancing() {
+	case StrategyRoundRobin, StrategyLeastConnections, StrategyConsistentHash:
+	default:
+		return fmt.Errorf("unknown load balancing strategy %q", h.Strategy)
+	}
+
+	if h.HealthCheck != nil && (h.HealthCheck.Path == "" || h.HealthCheck.Interval <= 0) {
+		return fmt.Errorf("health check needs a path and an interval")
+	}
+
+	if h.Outlier != nil && (h.Outlier.Consecutive5xx <= 0 || h.Outlier.EjectionTime <= 0) {
+		return fmt.Errorf("outlier detection needs consecutive-5xx and ejection-time")
+	}
+
+	if h.Timeout < 0 {
+		return fmt.Errorf("negative timeout")
+	}
+
+	if h.Retry != nil && (h.Retry.Attempts <= 0 || h.Retry.Backoff < 0 || h.Retry.MaxBackoff < 0) {
+		return fmt.Errorf("retry needs a positive number of attempts")
+	}
+
+	return nil
+}
+
+// CircuitBreaker opens after FailureThreshold failures in a row, rejects every request for OpenDuration
+// and then closes again once HalfOpenRequests probes succeeded (1 by default)
+type CircuitBreaker struct {
+	FailureThreshold int           `yaml:"failure-threshold"`
+	OpenDuration     time.Duration `yaml:"open-duration"`
+	HalfOpenRequests int           `yaml:"half-open-requests,omitempty"`
+}
+
+// validateRewrite checks the upstream path of an http route can be built from its path
+func validateRewrite(path string, variables map[string]bool, h HTTP) error {
+	if h.Target != "" && h.StripPrefix != "" {
+		return fmt.Errorf("target and strip-prefix cannot be used together")
+	}
+
+	if h.Target != "" && !strings.HasPrefix(h.Target, "/") {
+		return fmt.Errorf("target %s must start with /", h.Target)
+	}
+
+	for _, name := range h.TargetVariables() {
+		if !variables[name] {
+			return fmt.Errorf("target variable {%s} is not a variable of the path", name)
+		}
+	}
+
+	if h.StripPrefix != "" && !strings.HasPrefix(path, h.StripPrefix) {
+		return fmt.Errorf("path does not start with %s", h.StripPrefix)
+	}
+
+	return nil
 }
 
 type URL struct {
-	Method string `json:"method"`
-	Nsq    *Topic `json:"nsq"`
-	HTTP   *HTTP  `json:"http"`
-	Path   string `json:"path"`
+	Method string `yaml:"method"`
+	Nsq    *Topic `yaml:"nsq,omitempty"`
+	HTTP   *HTTP  `yaml:"http,omitempty"`
+	Path   string `yaml:"path"`
+	// Breaker guards the upstream or the queue of the route, there is none when it is not set
+	Breaker *CircuitBreaker `yaml:"circuit-breaker,omitempty"`
+	// Schema is the file of the JSON Schema the requests must match, see schemaDocument
+	Schema string `yaml:"schema,omitempty"`
+	// Auth restricts the route to authenticated callers, anyone can use it when it is not set
+	Auth *RouteAuth `yaml:"auth,omitempty"`
+	// RateLimit caps the requests of each client of the route, there is no limit when it is not set
+	RateLimit *RateLimit `yaml:"rate-limit,omitempty"`
+}
+
+// Rate limit keys that are not a path variable
+const (
+	RateKeyIP     = "ip"
+	RateKeyAPIKey = "api-key"
+)
+
+// RateLimit is a token bucket that lets Requests through per Period on average, in bursts of up to
+// Burst requests (Requests when not set). Key is what requests are counted by: RateKeyIP, RateKeyAPIKey,
+// the subject of the caller on routes with an api-key authenticator, or a path variable such as `{id}`
+// on authenticated routes.
+type RateLimit struct {
+	Requests int           `yaml:"requests"`
+	Period   time.Duration `yaml:"period"`
+	Burst    int           `yaml:"burst,omitempty"`
+	Key      string        `yaml:"key"`
+}
+
+// Capacity returns the size of the bucket
+func (l RateLimit) Capacity() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Requests
+}
+
+// TokensPerSecond returns how fast the bucket refills
+func (l RateLimit) TokensPerSecond() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// KeyVariable returns the name of the path variable requests are counted by without braces
+func (l RateLimit) KeyVariable() string {
+	return strings.TrimSuffix(strings.TrimPrefix(l.Key, "{"), "}")
+}
+
+// Route returns the method and path of the route, the way it is identified in logs and in the admin API
+func (u URL) Route() string {
+	return strings.ToUpper(u.Method) + " " + u.Path
 }
 
 func ParseFileConfig(filename string) (Config, error) {
@@ -32,12 +394,169 @@ func ParseFileConfig(filename string) (Config, error) {
 		return Config{}, err
 	}
 
+	return ParseConfig(source)
+}
+
+// WriteFileConfig writes c to filename as yaml, replacing the file atomically
+func WriteFileConfig(filename string, c Config) error {
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
+
+// ParseConfig unmarshals and validates a yaml config
+func ParseConfig(source []byte) (Config, error) {
 	c := Config{}
 
-	err = yaml.Unmarshal(source, &c)
+	err := yaml.Unmarshal(source, &c)
 	if err != nil {
 		return Config{}, err
 	}
 
+	if err = c.Validate(); err != nil {
+		return Config{}, err
+	}
+
 	return c, nil
 }
+
+// Validate checks the routes can be registered as described
+func (c Config) Validate() error {
+	for name, a := range c.Authenticators {
+		if _, err := newIdentityProvider(a); err != nil {
+			return fmt.Errorf("authenticator %s: %v", name, err)
+		}
+	}
+
+	routes := map[string]bool{}
+
+	for _, u := range c.Urls {
+		// A path can have several methods, each with its own backend, but only one backend per method
+		route := u.Route()
+		if routes[route] {
+			return fmt.Errorf("route %s is configured more than once", route)
+		}
+		routes[route] = true
+		variables := pathVariables(u.Path)
+
+		if u.Nsq != nil && u.Nsq.ProducerMode() != ModeSync && u.Nsq.ProducerMode() != ModeAsync {
+			return fmt.Errorf("route %s %s: unknown producer mode %q", u.Method, u.Path, u.Nsq.Mode)
+		}
+
+		if u.Nsq != nil && u.Nsq.FailurePolicy() != PolicyFailClosed && u.Nsq.FailurePolicy() != PolicyStoreAndForward {
+			return fmt.Errorf("route %s %s: unknown failure policy %q", u.Method, u.Path, u.Nsq.Policy)
+		}
+
+		// The async producer reports broker failures once the client got its answer, too late to store the
+		// message or to tell the breaker
+		if u.Nsq != nil && u.Nsq.ProducerMode() == ModeAsync && u.Nsq.FailurePolicy() == PolicyStoreAndForward {
+			return fmt.Errorf("route %s %s: %s needs %s mode", u.Method, u.Path, PolicyStoreAndForward, ModeSync)
+		}
+		if u.Nsq != nil && u.Nsq.ProducerMode() == ModeAsync && u.Breaker != nil {
+			return fmt.Errorf("route %s %s: circuit-breaker needs %s mode", u.Method, u.Path, ModeSync)
+		}
+
+		if u.HTTP != nil {
+			if err := u.HTTP.validate(); err != nil {
+				return fmt.Errorf("route %s %s: %v", u.Method, u.Path, err)
+			}
+
+			if err := validateRewrite(u.Path, variables, *u.HTTP); err != nil {
+				return fmt.Errorf("route %s %s: %v", u.Method, u.Path, err)
+			}
+
+			if u.HTTP.LoadBalancing() == StrategyConsistentHash && !variables[u.HTTP.HashVariable()] {
+				return fmt.Errorf("route %s %s: hash key {%s} is not a variable of the path", u.Method, u.Path, u.HTTP.HashVariable())
+			}
+		}
+
+		if u.Breaker != nil && (u.Breaker.FailureThreshold <= 0 || u.Breaker.OpenDuration <= 0) {
+			return fmt.Errorf("route %s %s: circuit breaker needs failure-threshold and open-duration", u.Method, u.Path)
+		}
+
+		if u.Schema != "" {
+			if _, err := loadSchema(u.Schema); err != nil {
+				return fmt.Errorf("route %s %s: invalid schema %s: %v", u.Method, u.Path, u.Schema, err)
+			}
+		}
+
+		if u.Auth != nil {
+			if err := c.validateAuth(variables, *u.Auth); err != nil {
+				return fmt.Errorf("route %s %s: %v", u.Method, u.Path, err)
+			}
+		}
+
+		if u.RateLimit != nil {
+			if err := c.validateRateLimit(variables, u.Auth, *u.RateLimit); err != nil {
+				return fmt.Errorf("route %s %s: %v", u.Method, u.Path, err)
+			}
+		}
+
+		if u.Nsq != nil && u.Nsq.Key != "" && !variables[u.Nsq.KeyVariable()] {
+			return fmt.Errorf("route %s %s: key {%s} is not a variable of the path", u.Method, u.Path, u.Nsq.KeyVariable())
+		}
+	}
+
+	return nil
+}
+
+func (c Config) validateAuth(variables map[string]bool, auth RouteAuth) error {
+	if len(auth.Authenticators) == 0 {
+		return fmt.Errorf("auth needs at least one authenticator")
+	}
+
+	for _, name := range auth.Authenticators {
+		if _, ok := c.Authenticators[name]; !ok {
+			return fmt.Errorf("unknown authenticator %s", name)
+		}
+	}
+
+	for variable, claim := range auth.Bind {
+		if claim == "" {
+			return fmt.Errorf("path variable {%s} is bound to no claim", variable)
+		}
+		if !variables[variable] {
+			return fmt.Errorf("bound variable {%s} is not a variable of the path", variable)
+		}
+	}
+
+	return nil
+}
+
+func (c Config) validateRateLimit(variables map[string]bool, auth *RouteAuth, l RateLimit) error {
+	if l.Requests <= 0 || l.Period <= 0 || l.Burst < 0 {
+		return fmt.Errorf("rate limit needs a positive number of requests and period")
+	}
+
+	switch l.Key {
+	case RateKeyIP:
+		return nil
+	case RateKeyAPIKey:
+		// The requests are counted by the subject of the key, which only an authenticated route knows
+		if auth != nil {
+			for _, name := range auth.Authenticators {
+				if c.Authenticators[name].Type == AuthAPIKey {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("rate limit key %s needs an %s authenticator", RateKeyAPIKey, AuthAPIKey)
+	}
+
+	if !strings.HasPrefix(l.Key, "{") || !variables[l.KeyVariable()] {
+		return fmt.Errorf("rate limit key %s is neither %s, %s nor a variable of the path", l.Key, RateKeyIP, RateKeyAPIKey)
+	}
+	// Anyone could otherwise use up the bucket of someone else's {id}
+	if auth == nil {
+		return fmt.Errorf("rate limit key %s needs auth", l.Key)
+	}
+	return nil
+}
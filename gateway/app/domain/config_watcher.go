@@ -0,0 +1,92 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Reloader applies a new config, it returns an error when the config is rejected
+type Reloader interface {
+	Reload(config Config) error
+}
+
+// ConfigWatcher reloads the gateway config whenever its file changes or a SIGHUP is received
+type ConfigWatcher struct {
+	filename string
+	interval time.Duration
+	reloader Reloader
+
+	// content is the file content last applied, the file is only reloaded when it differs
+	content []byte
+}
+
+// NewConfigWatcher checks filename for changes every interval
+func NewConfigWatcher(filename string, interval time.Duration, reloader Reloader) *ConfigWatcher {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Warn().Err(err).Str("file", filename).Msg("could not read config")
+	}
+
+	return &ConfigWatcher{
+		filename: filename,
+		interval: interval,
+		reloader: reloader,
+		content:  content,
+	}
+}
+
+// Watch blocks until ctx is cancelled
+func (c *ConfigWatcher) Watch(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			log.Info().Str("file", c.filename).Msg("SIGHUP received, reloading config")
+			c.reload(true)
+		case <-ticker.C:
+			c.reload(false)
+		}
+	}
+}
+
+// reload parses the config file and applies it when it changed or force is true.
+// An invalid config is logged and the current routes are kept.
+func (c *ConfigWatcher) reload(force bool) {
+	content, err := ioutil.ReadFile(c.filename)
+	if err != nil {
+		log.Error().Err(err).Str("file", c.filename).Msg("could not read config, keeping current routes")
+		return
+	}
+
+	if !force && bytes.Equal(content, c.content) {
+		return
+	}
+
+	// The content is remembered even if it is rejected so that an invalid file is reported once
+	c.content = content
+
+	config, err := ParseConfig(content)
+	if err != nil {
+		log.Error().Err(err).Str("file", c.filename).Msg("invalid config, keeping current routes")
+		return
+	}
+
+	if err := c.reloader.Reload(config); err != nil {
+		log.Error().Err(err).Str("file", c.filename).Msg("config rejected, keeping current routes")
+	}
+}
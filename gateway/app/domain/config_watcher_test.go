@@ -0,0 +1,61 @@
+package domain
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+type MockReloader struct {
+	configs []Config
+}
+
+func (m *MockReloader) Reload(config Config) error {
+	m.configs = append(m.configs, config)
+	return nil
+}
+
+func TestConfigWatcher(t *testing.T) {
+	f, err := ioutil.TempFile("", "config*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	write := func(content string) {
+		if err := ioutil.WriteFile(f.Name(), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("urls:\n  - path: /drivers/{id}\n    method: GET\n    http:\n      host: zombie-driver\n")
+
+	m := &MockReloader{}
+	w := NewConfigWatcher(f.Name(), time.Second, m)
+
+	// Unchanged file is not reloaded
+	w.reload(false)
+	if len(m.configs) != 0 {
+		t.Fatalf("was not expecting a reload, got %d", len(m.configs))
+	}
+
+	// Invalid file is rejected before reaching the reloader
+	write("urls:\n  - path: /drivers/{id}\n    method: PATCH\n    nsq:\n      topic: locations\n      mode: unknown\n")
+	w.reload(false)
+	if len(m.configs) != 0 {
+		t.Fatalf("was not expecting invalid config to be reloaded, got %d", len(m.configs))
+	}
+
+	write("urls:\n  - path: /drivers/{id}\n    method: GET\n    http:\n      host: zombie-driver-v2\n")
+	w.reload(false)
+	if len(m.configs) != 1 || m.configs[0].Urls[0].HTTP.Host != "zombie-driver-v2" {
+		t.Fatalf("was expecting new config to be reloaded, got %+v", m.configs)
+	}
+
+	// SIGHUP reloads even when the file did not change
+	w.reload(true)
+	if len(m.configs) != 2 {
+		t.Errorf("was expecting a forced reload, got %d", len(m.configs))
+	}
+}
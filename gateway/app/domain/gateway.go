@@ -1,9 +1,18 @@
 package domain
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/heetch/MehdiSouilhed-technical-test/common"
@@ -15,9 +24,26 @@ type QueueProducer interface {
 }
 
 type RequestHandler struct {
-	client   *http.Client
-	producer common.Sender
-	router   *mux.Router
+	client    *http.Client
+	producers map[string]common.Sender
+	outbox    *common.Outbox
+	limiter   Limiter
+
+	// routes holds the current *routeTable, it is swapped as a whole when the config is reloaded
+	routes atomic.Value
+	// reloadMu serialises the updates of the routes
+	reloadMu sync.Mutex
+}
+
+// routeTable is a router along with the config its routes were registered from.
+// Its context is cancelled once the routes are replaced, to stop their health checks.
+type routeTable struct {
+	router *mux.Router
+	config Config
+	ctx    context.Context
+	cancel context.CancelFunc
+	// breakers of the routes by Route(), they are carried over a reload when their config is unchanged
+	breakers map[string]*Breaker
 }
 
 type Message struct {
@@ -27,132 +53,493 @@ type Message struct {
 
 const (
 	logTraceID = "traceID"
+
+	// producerName identifies the gateway in the metadata of the messages it publishes
+	producerName = "gateway"
+	// MessageSchemaVersion is the version of the Message envelope published by the gateway
+	MessageSchemaVersion = "1"
 )
 
 func NewRequestHandler(p common.Sender, client *http.Client, r *mux.Router) (*RequestHandler, error) {
 
-	return &RequestHandler{
-		producer: p,
-		client:   client,
-		router:   r,
-	}, nil
+	s := &RequestHandler{
+		producers: map[string]common.Sender{ModeSync: p},
+		client:    client,
+		limiter:   NewMemoryLimiter(),
+	}
+	r.Use(common.HTTPTracing, stampTraceID, common.HTTPMetrics)
+	r.NotFoundHandler = http.HandlerFunc(notFound)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.routes.Store(&routeTable{router: r, ctx: ctx, cancel: cancel, breakers: map[string]*Breaker{}})
+
+	return s, nil
+}
+
+// SetOutbox sets the outbox used by the store-and-forward routes
+func (s *RequestHandler) SetOutbox(o *common.Outbox) {
+	s.outbox = o
+}
+
+// SetLimiter sets the limiter of the rate limited routes, a MemoryLimiter by default
+func (s *RequestHandler) SetLimiter(l Limiter) {
+	s.limiter = l
+}
+
+// SetProducer registers the producer used by the async routes configured with mode
+func (s *RequestHandler) SetProducer(mode string, p common.Sender) {
+	s.producers[mode] = p
 }
 
 func (s *RequestHandler) GetRouter() *mux.Router {
-	return s.router
+	return s.table().router
+}
+
+// GetConfig returns the config the current routes were registered from
+func (s *RequestHandler) GetConfig() Config {
+	return s.table().config
+}
+
+// Breakers returns the state of the circuit breakers of the current routes, sorted by route
+func (s *RequestHandler) Breakers() []BreakerState {
+	t := s.table()
+
+	states := make([]BreakerState, 0, len(t.breakers))
+	for _, b := range t.breakers {
+		states = append(states, b.State())
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Route < states[j].Route
+	})
+	return states
+}
+
+func (s *RequestHandler) table() *routeTable {
+	return s.routes.Load().(*routeTable)
+}
+
+// ServeHTTP routes the request with the current router. A request keeps the router it started
+// with until it completes, even if the routes are reloaded in the meantime.
+func (s *RequestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Only the gateway tells the services who the caller is
+	r.Header.Del(common.SubjectHeader)
+	s.GetRouter().ServeHTTP(w, r)
+}
+
+// stampTraceID is a mux middleware, run once HTTPTracing started the span of the request, that sets the
+// trace ID in the X-Trace-Id header of the request and of the response so that every step of the request
+// logs, forwards and returns the same one
+func stampTraceID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceID := common.ExtractTraceIDFromReq(r)
+		r.Header.Set(common.TraceIDHeader, traceID)
+		w.Header().Set(common.TraceIDHeader, traceID)
+		next.ServeHTTP(w, r)
+	})
 }
 
+// Gateway registers the routes described by config on the current router
 func (s *RequestHandler) Gateway(config Config) {
+	t := s.table()
+	breakers := s.register(t.ctx, t.router, config, t.breakers)
+	for route, b := range t.breakers {
+		if _, ok := breakers[route]; !ok {
+			breakers[route] = b
+		}
+	}
+	s.routes.Store(&routeTable{router: t.router, config: config, ctx: t.ctx, cancel: t.cancel, breakers: breakers})
+}
+
+// Reload validates config and replaces all the routes with the ones it describes.
+// The current routes are kept when config is invalid.
+func (s *RequestHandler) Reload(config Config) error {
+	_, err := s.Update(func(Config) (Config, error) {
+		return config, nil
+	})
+	return err
+}
+
+// Update replaces the routes with the config returned by update, which is given the current config.
+// No other update can happen in the meantime. The current routes are kept if update fails or
+// the config it returns is invalid.
+func (s *RequestHandler) Update(update func(Config) (Config, error)) (Config, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	config, err := update(s.GetConfig())
+	if err != nil {
+		return Config{}, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+
+	previous := s.table()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	router := mux.NewRouter()
+	router.Use(common.HTTPTracing, stampTraceID, common.HTTPMetrics)
+	router.NotFoundHandler = http.HandlerFunc(notFound)
+	breakers := s.register(ctx, router, config, previous.breakers)
+
+	s.routes.Store(&routeTable{router: router, config: config, ctx: ctx, cancel: cancel, breakers: breakers})
+	previous.cancel()
+
+	log.Info().Int("routes", len(config.Urls)).Msg("gateway routes reloaded")
+	return config, nil
+}
+
+// register adds the routes described by config to router and returns their breakers. Routes sharing
+// a path are registered as a single handler that dispatches the request to the backend configured for
+// its method. A breaker of previous is kept, with its state, when the route still has the same one.
+func (s *RequestHandler) register(ctx context.Context, router *mux.Router, config Config, previous map[string]*Breaker) map[string]*Breaker {
+	paths := []string{}
+	routes := map[string]methodHandlers{}
+	breakers := map[string]*Breaker{}
+	providers := newIdentityProviders(config)
 
 	for _, c := range config.Urls {
+		method := strings.ToUpper(c.Method)
+
+		var breaker *Breaker
+		if c.Breaker != nil {
+			if kept, ok := previous[c.Route()]; ok && kept.config == c.Breaker.withDefaults() {
+				breaker = kept
+			} else {
+				breaker = NewBreaker(c.Route(), *c.Breaker)
+				breakerState.WithLabelValues(c.Route()).Set(breakerStateValues[BreakerClosed])
+			}
+			breakers[c.Route()] = breaker
+		}
+
+		var handler http.HandlerFunc
 		switch {
 		case c.Nsq != nil:
-			s.makeAsyncHandler(c.Method, c.Path, c.Nsq.Topic)
+			handler = s.makeAsyncHandler(method, c.Path, *c.Nsq, breaker)
 
 		case c.HTTP != nil:
-			host := c.HTTP.Host
-			s.makeSyncHandler(c.Method, c.Path, host)
+			balancer := NewBalancer(*c.HTTP)
+			go balancer.HealthCheck(ctx, s.client)
+			handler = s.makeSyncHandler(method, c.Path, *c.HTTP, balancer, breaker)
+
+		default:
+			continue
 		}
+
+		if c.Schema != "" {
+			schema, err := loadSchema(c.Schema)
+			if err != nil {
+				// The config was validated, the file must have changed since
+				log.Error().Err(err).Str("schema", c.Schema).Msgf("could not load schema of %s %s, requests are not validated", method, c.Path)
+			} else {
+				handler = validateSchema(schema, handler)
+			}
+		}
+
+		// Requests are counted once their caller is authenticated, so that a client cannot use up
+		// the limit of an API key or a driver that is not its own
+		if c.RateLimit != nil {
+			handler = rateLimit(c.Route(), *c.RateLimit, s.limiter, handler)
+		}
+
+		// Callers are authenticated before anything is done with their request
+		if c.Auth != nil {
+			handler = authenticate(*c.Auth, providers, handler)
+		}
+
+		if _, ok := routes[c.Path]; !ok {
+			paths = append(paths, c.Path)
+			routes[c.Path] = methodHandlers{}
+		}
+		routes[c.Path][method] = handler
 	}
+
+	for _, path := range paths {
+		router.Handle(path, routes[path])
+	}
+
+	return breakers
 }
 
-func (s *RequestHandler) makeAsyncHandler(method, path, topic string) {
+// notFound answers the requests that match no route
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("no route matches %s", r.URL.Path), common.ExtractTraceIDFromReq(r))
+}
 
-	log.Info().Msgf("Registering async handler for [method|path|topic]: [%s|%s|%s]", method, path, topic)
+// methodHandlers dispatches a request to the handler registered for its method
+type methodHandlers map[string]http.HandlerFunc
 
-	s.router.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+func (m methodHandlers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler, ok := m[r.Method]; ok {
+		handler(w, r)
+		return
+	}
 
-		if r.Method != method {
-			w.WriteHeader(http.StatusNotFound)
-			return
+	traceID := common.ExtractTraceIDFromReq(r)
+	w.Header().Set(headerAllow, strings.Join(m.methods(), ", "))
+	writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed,
+		fmt.Sprintf("%s is not allowed on %s", r.Method, r.URL.Path), traceID)
+}
+
+// methods returns the methods with a handler, sorted
+func (m methodHandlers) methods() []string {
+	methods := make([]string, 0, len(m))
+	for method := range m {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+func (s *RequestHandler) makeAsyncHandler(method, path string, t Topic, breaker *Breaker) http.HandlerFunc {
+	topic := t.Topic
+	keyVariable := t.KeyVariable()
+
+	producer, ok := s.producers[t.ProducerMode()]
+	if !ok {
+		log.Warn().Msgf("No %s producer registered for %s %s, falling back to %s", t.ProducerMode(), method, path, ModeSync)
+		producer = s.producers[ModeSync]
+	}
+
+	// The breaker sits in front of the producer rather than the outbox, so that store-and-forward
+	// routes go straight to the outbox while the queue is unreachable
+	if breaker != nil {
+		producer = breakerSender{sender: producer, breaker: breaker}
+	}
+
+	timeout := t.PublishTimeout()
+	policy := t.FailurePolicy()
+	if policy == PolicyStoreAndForward {
+		if s.outbox != nil {
+			producer = common.NewOutboxSender(producer, s.outbox)
+		} else {
+			log.Warn().Msgf("No outbox set for %s %s, falling back to %s", method, path, PolicyFailClosed)
+			policy = PolicyFailClosed
 		}
+	}
+
+	log.Info().Msgf("Registering async handler for [method|path|topic|key|mode|policy]: [%s|%s|%s|%s|%s|%s]",
+		method, path, topic, keyVariable, t.ProducerMode(), policy)
 
+	return func(w http.ResponseWriter, r *http.Request) {
 		traceID := common.ExtractTraceIDFromReq(r)
 
-		request, err := ioutil.ReadAll(r.Body)
+		if r.ContentLength > MaxBodyBytes {
+			writeError(w, http.StatusRequestEntityTooLarge, CodeBodyTooLarge,
+				fmt.Sprintf("body must not exceed %d bytes", MaxBodyBytes), traceID)
+			return
+		}
+
+		// Reading one byte past the limit tells a body that is too large apart from one that fits exactly
+		request, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxBodyBytes+1))
 		if err != nil {
-			log.Error().Err(err).Str(logTraceID, traceID)
+			log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request body")
+			writeError(w, http.StatusBadRequest, CodeInvalidBody, "could not read body", traceID)
+			return
+		}
+
+		if len(request) > MaxBodyBytes {
+			writeError(w, http.StatusRequestEntityTooLarge, CodeBodyTooLarge,
+				fmt.Sprintf("body must not exceed %d bytes", MaxBodyBytes), traceID)
+			return
+		}
+
+		// Consumers unmarshal the body, a message they cannot parse would only fail once in the queue
+		if len(request) > 0 && !json.Valid(request) {
+			writeError(w, http.StatusBadRequest, CodeInvalidBody, "body is not valid JSON", traceID)
+			return
 		}
 
 		urlVars := mux.Vars(r)
-		// Pass the traceID downstream
-		urlVars[common.TraceIDHeader] = traceID
 
 		m := Message{Body: request, Parameters: urlVars}
 
 		mbytes, err := json.Marshal(m)
 		if err != nil {
-			log.Error().Err(err).Str(logTraceID, traceID)
+			log.Error().Err(err).Str(logTraceID, traceID).Msg("could not marshal message")
+			writeError(w, http.StatusInternalServerError, CodeInternalError, "could not build message", traceID)
+			return
 		}
 
 		log.Info().Interface("params", urlVars).Str("topic", topic).Msg("transforming request to async event")
-		err = s.producer.Send(topic, string(mbytes))
+		// Pass the traceID downstream in the message metadata
+		meta := common.NewMetadata(traceID, producerName, MessageSchemaVersion)
+		meta.Subject = r.Header.Get(common.SubjectHeader)
+		// A broker that does not answer in time must not hold the request past any client timeout
+		ctx, cancel := context.WithTimeout(common.ContextWithMetadata(r.Context(), meta), timeout)
+		defer cancel()
+		err = producer.Send(ctx, topic, urlVars[keyVariable], string(mbytes))
+		var open OpenError
+		if errors.As(err, &open) {
+			log.Warn().Str(logTraceID, traceID).Str("topic", topic).Msg("circuit breaker open, message not published")
+			writeCircuitOpen(w, open, traceID)
+			return
+		}
 		if err != nil {
-			log.Error().Err(err).Str(logTraceID, traceID).
+			log.Error().Err(err).Str(logTraceID, traceID).Str("policy", policy).
 				Msg("could not publish message")
-
+			writeError(w, http.StatusServiceUnavailable, CodeQueueUnavailable, "could not publish message", traceID)
+			return
 		}
-		w.WriteHeader(http.StatusOK)
-	})
+
+		writeJSON(w, http.StatusAccepted, traceID, AcceptedResponse{MessageID: meta.MessageID, TraceID: traceID})
+	}
 }
 
-func (s *RequestHandler) makeSyncHandler(method, path, host string) {
+func (s *RequestHandler) makeSyncHandler(method, path string, h HTTP, balancer *Balancer, breaker *Breaker) http.HandlerFunc {
+	hosts := make([]string, 0, len(balancer.upstreams))
+	for _, u := range balancer.upstreams {
+		hosts = append(hosts, u.host)
+	}
 
-	log.Info().Msgf("Registering http proxy handler for [method|path|host]: [%s|%s|%s]", method, path, host)
+	route := syncRoute{
+		balancer:        balancer,
+		timeout:         h.ProxyTimeout(),
+		retry:           h.Retry,
+		requestHeaders:  h.RequestHeaders,
+		responseHeaders: h.ResponseHeaders,
+		target:          h.Target,
+		stripPrefix:     h.StripPrefix,
+		queryRename:     h.QueryRename,
+	}
 
-	s.router.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+	// Sending a request twice is only safe when the method is idempotent
+	if route.retry != nil && !idempotent(method) {
+		log.Warn().Msgf("Retries of %s %s are ignored, %s is not idempotent", method, path, method)
+		route.retry = nil
+	}
 
-		if r.Method != method {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
+	log.Info().Msgf("Registering http proxy handler for [method|path|hosts|strategy|timeout]: [%s|%s|%s|%s|%s]",
+		method, path, strings.Join(hosts, ","), balancer.strategy, route.timeout)
 
+	return func(w http.ResponseWriter, r *http.Request) {
 		traceID := common.ExtractTraceIDFromReq(r)
 
-		res, err := s.proxy("http://"+host+r.URL.Path, r)
-		if err != nil {
-			log.Error().Err(err).Str(logTraceID, traceID)
-			w.WriteHeader(http.StatusBadRequest)
+		// The body of a request that may be retried is kept so that it can be sent again
+		var body []byte
+		if route.retry != nil {
+			var err error
+			body, err = ioutil.ReadAll(io.LimitReader(r.Body, MaxBodyBytes+1))
+			if err != nil {
+				log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request body")
+				writeError(w, http.StatusBadRequest, CodeInvalidBody, "could not read body", traceID)
+				return
+			}
+			if len(body) > MaxBodyBytes {
+				writeError(w, http.StatusRequestEntityTooLarge, CodeBodyTooLarge,
+					fmt.Sprintf("body must not exceed %d bytes", MaxBodyBytes), traceID)
+				return
+			}
+		}
+
+		var generation uint64
+		if breaker != nil {
+			var err error
+			if generation, err = breaker.Allow(); err != nil {
+				log.Warn().Str(logTraceID, traceID).Msg("circuit breaker open, request not proxied")
+				writeCircuitOpen(w, err.(OpenError), traceID)
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), route.timeout)
+		defer cancel()
+
+		res, err := s.send(ctx, route, r, body, traceID)
+		switch {
+		case err == ErrNoUpstream:
+			breakerDone(breaker, generation, false)
+			log.Error().Err(err).Str(logTraceID, traceID).Msg("could not pick upstream")
+			writeError(w, http.StatusServiceUnavailable, CodeUpstreamUnavailable, err.Error(), traceID)
+			return
+
+		case errors.Is(err, context.DeadlineExceeded):
+			breakerDone(breaker, generation, false)
+			log.Error().Err(err).Str(logTraceID, traceID).Dur("timeout", route.timeout).Msg("upstream timed out")
+			writeError(w, http.StatusGatewayTimeout, CodeUpstreamTimeout,
+				fmt.Sprintf("upstream did not answer within %s", route.timeout), traceID)
+			return
+
+		case errors.Is(err, context.Canceled):
+			// The client went away, which says nothing about the upstream
+			if breaker != nil {
+				breaker.Release(generation)
+			}
+			log.Info().Err(err).Str(logTraceID, traceID).Msg("client closed the request")
+			return
+
+		case err != nil:
+			breakerDone(breaker, generation, false)
+			log.Error().Err(err).Str(logTraceID, traceID).Msg("could not reach upstream")
+			writeError(w, http.StatusBadGateway, CodeBadGateway, "could not reach upstream", traceID)
 			return
 		}
+		breakerDone(breaker, generation, res.StatusCode < http.StatusInternalServerError)
 
 		defer res.Body.Close()
-		respBytes, err := ioutil.ReadAll(res.Body)
+		if err := copyResponse(w, res, route.responseHeaders); err != nil {
+			// The status is already sent, the client sees a truncated body
+			log.Error().Err(err).Str(logTraceID, traceID).Msg("could not stream upstream response")
+		}
+	}
+}
 
+// send proxies r to an upstream picked by the balancer of route. When route has a retry, a request that
+// failed or got a retryable status is sent again, possibly to another upstream, as long as ctx is not done.
+// body replaces the body of r when it is not nil.
+func (s *RequestHandler) send(ctx context.Context, route syncRoute, r *http.Request, body []byte, traceID string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		upstream, err := route.balancer.Pick(r)
 		if err != nil {
-			log.Error().Err(err).Str(logTraceID, traceID)
-			w.WriteHeader(http.StatusInternalServerError)
+			return nil, err
 		}
 
-		w.WriteHeader(res.StatusCode)
+		// Only the failures of the upstream count towards its ejection: a client hanging up or a request
+		// running out of time must not take a healthy host out for everyone
+		res, err := s.proxy(ctx, route, upstream.host, r, body, traceID)
+		switch {
+		case err != nil && ctx.Err() != nil:
+			route.balancer.Release(upstream)
+		case err != nil:
+			route.balancer.Done(upstream, 0, err)
+		default:
+			route.balancer.Done(upstream, res.StatusCode, nil)
+		}
 
-		_, err = w.Write(respBytes)
-		if err != nil {
-			log.Error().Err(err).Str(logTraceID, traceID)
-			w.WriteHeader(http.StatusInternalServerError)
+		retry := route.retry
+		if retry == nil || attempt >= retry.Attempts || ctx.Err() != nil || (err == nil && !retry.Retryable(res.StatusCode)) {
+			return res, err
 		}
-	})
-}
 
-func (s *RequestHandler) proxy(proxyURL string, r *http.Request) (*http.Response, error) {
+		if res != nil {
+			log.Warn().Str(logTraceID, traceID).Str("host", upstream.host).Int("status", res.StatusCode).
+				Int("attempt", attempt+1).Msg("retrying request")
+			res.Body.Close()
+		} else {
+			log.Warn().Err(err).Str(logTraceID, traceID).Str("host", upstream.host).
+				Int("attempt", attempt+1).Msg("retrying request")
+		}
 
-	req, err := http.NewRequest(r.Method, proxyURL, r.Body)
-	if err != nil {
-		log.Error().Err(err).Msg("error")
-		return nil, err
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retry.Policy().Backoff(attempt + 1)):
+		}
 	}
+}
 
-	params := r.URL.Query()
-	req.URL.RawQuery = params.Encode()
-
-	// Pass the traceID downstream
-	req.Header.Add(common.TraceIDHeader, common.ExtractTraceIDFromReq(r))
-
-	response, err := s.client.Do(req)
-	if err != nil {
-		log.Error().Err(err).Msg("error")
-		return nil, err
+// idempotent reports whether sending a request with method several times has the same effect as sending it once
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
 	}
+	return false
+}
 
-	return response, nil
+// breakerDone reports the outcome of a request to breaker, if the route has one
+func breakerDone(breaker *Breaker, generation uint64, success bool) {
+	if breaker != nil {
+		breaker.Done(generation, success)
+	}
 }
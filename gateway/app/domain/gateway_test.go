@@ -4,21 +4,35 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
 )
 
 type MockQueue struct {
 	Queue map[string][][]byte
+	Keys  []string
+	Err   error
 }
 
-func (m *MockQueue) Publish(topic string, body []byte) error {
-	m.Queue[topic] = append(m.Queue[topic], body)
+func (m *MockQueue) Send(ctx context.Context, topic, key, msg string) error {
+	if m.Err != nil {
+		return m.Err
+	}
+	m.Queue[topic] = append(m.Queue[topic], []byte(msg))
+	m.Keys = append(m.Keys, key)
 	return nil
 }
 
@@ -109,14 +123,332 @@ func TestAsyncHandler(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	if status := rr.Code; status != http.StatusOK {
+	if status := rr.Code; status != http.StatusAccepted {
 		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusOK)
+			status, http.StatusAccepted)
 	}
 
 	if _, ok := m.Queue["halloween"]; !ok {
 		t.Errorf("was expecting a new entry in queue")
 	}
+
+	res := AcceptedResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.MessageID == "" || res.TraceID == "" || rr.Header().Get(common.TraceIDHeader) != res.TraceID {
+		t.Errorf("was expecting a message ID and trace ID in response, got %+v", res)
+	}
+}
+
+// test that invalid requests are rejected with a structured error and never published
+func TestAsyncHandlerInvalidRequest(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         []byte
+		expectedCode int
+		expectedErr  string
+	}{
+		{
+			name:         "body is not JSON",
+			body:         []byte(`{"latitude":`),
+			expectedCode: http.StatusBadRequest,
+			expectedErr:  CodeInvalidBody,
+		},
+		{
+			name:         "body is too large",
+			body:         bytes.Repeat([]byte(" "), MaxBodyBytes+1),
+			expectedCode: http.StatusRequestEntityTooLarge,
+			expectedErr:  CodeBodyTooLarge,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &MockQueue{Queue: map[string][][]byte{}}
+			r, _ := NewRequestHandler(m, &http.Client{}, mux.NewRouter())
+
+			r.Gateway(Config{
+				Urls: []URL{
+					{
+						Method: "PATCH",
+						Path:   "/drivers/{id}/locations",
+						Nsq: &Topic{
+							Topic: "locations",
+						},
+					},
+				},
+			})
+
+			req, err := http.NewRequest("PATCH", "/drivers/42/locations", bytes.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			http.Handler(r.GetRouter()).ServeHTTP(rr, req)
+
+			if status := rr.Code; status != test.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, test.expectedCode)
+			}
+
+			res := ErrorResponse{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Code != test.expectedErr || res.TraceID == "" {
+				t.Errorf("unexpected error response %+v", res)
+			}
+
+			if len(m.Queue) != 0 {
+				t.Errorf("was not expecting a new entry in queue")
+			}
+		})
+	}
+}
+
+// test that the message is keyed by the configured path variable
+func TestAsyncHandlerKey(t *testing.T) {
+	m := &MockQueue{Queue: map[string][][]byte{}}
+	r, _ := NewRequestHandler(m, &http.Client{}, mux.NewRouter())
+
+	config := Config{
+		Urls: []URL{
+			{
+				Method: "PATCH",
+				Path:   "/drivers/{id}/locations",
+				Nsq: &Topic{
+					Topic: "locations",
+					Key:   "{id}",
+				},
+			},
+		},
+	}
+	r.Gateway(config)
+
+	req, err := http.NewRequest("PATCH", "/drivers/42/locations", bytes.NewReader([]byte(`{}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	http.Handler(r.GetRouter()).ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(m.Keys) != 1 || m.Keys[0] != "42" {
+		t.Errorf("was expecting message keyed by driver id 42, got %v", m.Keys)
+	}
+}
+
+func TestConfigValidateKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     URL
+		wantErr bool
+	}{
+		{
+			name:    "key is not a path variable",
+			url:     URL{Method: "PATCH", Path: "/drivers/{id}/locations", Nsq: &Topic{Topic: "locations", Key: "driver"}},
+			wantErr: true,
+		},
+		{
+			name: "key",
+			url:  URL{Method: "PATCH", Path: "/drivers/{id}/locations", Nsq: &Topic{Topic: "locations", Key: "id"}},
+		},
+		{
+			name: "key of a variable with a pattern",
+			url:  URL{Method: "PATCH", Path: "/drivers/{id:[0-9]+}/locations", Nsq: &Topic{Topic: "locations", Key: "{id}"}},
+		},
+		{
+			name: "hash key of a variable with a pattern",
+			url: URL{Method: "GET", Path: "/drivers/{id:[0-9]+}",
+				HTTP: &HTTP{Hosts: []string{"a", "b"}, Strategy: StrategyConsistentHash, HashKey: "{id}"}},
+		},
+		{
+			name: "hash key is not a path variable",
+			url: URL{Method: "GET", Path: "/drivers/{id:[0-9]+}",
+				HTTP: &HTTP{Hosts: []string{"a", "b"}, Strategy: StrategyConsistentHash, HashKey: "{i}"}},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := Config{Urls: []URL{test.url}}
+			if err := config.Validate(); (err != nil) != test.wantErr {
+				t.Errorf("was expecting an error: %t, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestConfigValidateTopic(t *testing.T) {
+	breaker := &CircuitBreaker{FailureThreshold: 5, OpenDuration: time.Second}
+
+	tests := []struct {
+		name    string
+		topic   Topic
+		breaker *CircuitBreaker
+		wantErr bool
+	}{
+		{"sync store-and-forward", Topic{Topic: "locations", Policy: PolicyStoreAndForward}, nil, false},
+		{"async fail-closed", Topic{Topic: "locations", Mode: ModeAsync}, nil, false},
+		{"async store-and-forward", Topic{Topic: "locations", Mode: ModeAsync, Policy: PolicyStoreAndForward}, nil, true},
+		{"sync breaker", Topic{Topic: "locations"}, breaker, false},
+		{"async breaker", Topic{Topic: "locations", Mode: ModeAsync}, breaker, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			topic := test.topic
+			config := Config{Urls: []URL{{Method: "PATCH", Path: "/drivers/{id}/locations", Nsq: &topic, Breaker: test.breaker}}}
+
+			if err := config.Validate(); (err != nil) != test.wantErr {
+				t.Errorf("was expecting an error: %t, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+// test what the client gets back when the message cannot be published
+func TestAsyncHandlerPublishFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outbox, err := common.NewOutbox(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		policy         string
+		expectedCode   int
+		expectedOutbox int
+	}{
+		{
+			name:           "fail-closed",
+			policy:         PolicyFailClosed,
+			expectedCode:   http.StatusServiceUnavailable,
+			expectedOutbox: 0,
+		},
+		{
+			name:           "store-and-forward",
+			policy:         PolicyStoreAndForward,
+			expectedCode:   http.StatusAccepted,
+			expectedOutbox: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &MockQueue{Queue: map[string][][]byte{}, Err: errors.New("broker is down")}
+			r, _ := NewRequestHandler(m, &http.Client{}, mux.NewRouter())
+			r.SetOutbox(outbox)
+
+			r.Gateway(Config{
+				Urls: []URL{
+					{
+						Method: "PATCH",
+						Path:   "/drivers/{id}/locations",
+						Nsq: &Topic{
+							Topic:  "locations",
+							Policy: test.policy,
+						},
+					},
+				},
+			})
+
+			req, err := http.NewRequest("PATCH", "/drivers/42/locations", bytes.NewReader([]byte(`{}`)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			http.Handler(r.GetRouter()).ServeHTTP(rr, req)
+
+			if status := rr.Code; status != test.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, test.expectedCode)
+			}
+
+			if outbox.Len() != test.expectedOutbox {
+				t.Errorf("was expecting %d messages in outbox, got %d", test.expectedOutbox, outbox.Len())
+			}
+		})
+	}
+}
+
+// hangingQueue is a broker that never answers, Send only returns once ctx is done
+type hangingQueue struct{}
+
+func (hangingQueue) Send(ctx context.Context, topic, key, msg string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// test that a broker that does not answer only holds the request for the publish timeout
+func TestAsyncHandlerPublishTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name           string
+		policy         string
+		expectedCode   int
+		expectedOutbox int
+	}{
+		{name: "fail-closed", policy: PolicyFailClosed, expectedCode: http.StatusServiceUnavailable},
+		{name: "store-and-forward", policy: PolicyStoreAndForward, expectedCode: http.StatusAccepted, expectedOutbox: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outbox, err := common.NewOutbox(filepath.Join(dir, test.name), 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, _ := NewRequestHandler(hangingQueue{}, &http.Client{}, mux.NewRouter())
+			r.SetOutbox(outbox)
+			r.Gateway(Config{
+				Urls: []URL{
+					{
+						Method: "PATCH",
+						Path:   "/drivers/{id}/locations",
+						Nsq:    &Topic{Topic: "locations", Policy: test.policy, Timeout: 10 * time.Millisecond},
+					},
+				},
+			})
+
+			req, _ := http.NewRequest("PATCH", "/drivers/42/locations", bytes.NewReader([]byte(`{}`)))
+			rr := httptest.NewRecorder()
+
+			done := make(chan struct{})
+			go func() {
+				r.ServeHTTP(rr, req)
+				close(done)
+			}()
+
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("request is held past the publish timeout")
+			}
+
+			if rr.Code != test.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, test.expectedCode)
+			}
+			if outbox.Len() != test.expectedOutbox {
+				t.Errorf("was expecting %d messages in outbox, got %d", test.expectedOutbox, outbox.Len())
+			}
+		})
+	}
 }
 
 func TestAsyncHandlerNotMatching(t *testing.T) {
@@ -148,9 +480,13 @@ func TestAsyncHandlerNotMatching(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	if status := rr.Code; status != http.StatusNotFound {
+	if status := rr.Code; status != http.StatusMethodNotAllowed {
 		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusNotFound)
+			status, http.StatusMethodNotAllowed)
+	}
+
+	if allow := rr.Header().Get("Allow"); allow != "PUT" {
+		t.Errorf("was expecting Allow header with PUT, got %q", allow)
 	}
 
 	if _, ok := m.Queue["halloween"]; ok {
@@ -240,9 +576,9 @@ func TestSyncHandlerNotMatching(t *testing.T) {
 	rr := httptest.NewRecorder()
 	http.Handler(r.GetRouter()).ServeHTTP(rr, req)
 
-	if status := rr.Code; status != http.StatusNotFound {
+	if status := rr.Code; status != http.StatusMethodNotAllowed {
 		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusNotFound)
+			status, http.StatusMethodNotAllowed)
 	}
 
 	if rr.Body.String() == string(`ok`) {
@@ -250,7 +586,173 @@ func TestSyncHandlerNotMatching(t *testing.T) {
 	}
 }
 
+// test that several methods on the same path each reach their own backend
+func TestMultipleMethodsSamePath(t *testing.T) {
+	m := &MockQueue{Queue: map[string][][]byte{}}
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`ok`))
+	})
+
+	client, close := testingHTTPClient(h)
+	defer close()
+
+	r, _ := NewRequestHandler(m, client, mux.NewRouter())
+
+	r.Gateway(Config{
+		Urls: []URL{
+			{
+				Method: "GET",
+				Path:   "/drivers/{id}",
+				HTTP: &HTTP{
+					Host: "zombie-driver",
+				},
+			},
+			{
+				Method: "PATCH",
+				Path:   "/drivers/{id}",
+				Nsq: &Topic{
+					Topic: "locations",
+				},
+			},
+		},
+	})
+
+	tests := []struct {
+		method       string
+		expectedCode int
+		expectedBody string
+		expectQueued int
+	}{
+		{method: "GET", expectedCode: http.StatusOK, expectedBody: `ok`, expectQueued: 0},
+		{method: "PATCH", expectedCode: http.StatusAccepted, expectQueued: 1},
+		{method: "DELETE", expectedCode: http.StatusMethodNotAllowed, expectQueued: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, "/drivers/3", bytes.NewReader([]byte(`{}`)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			http.Handler(r.GetRouter()).ServeHTTP(rr, req)
+
+			if status := rr.Code; status != test.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, test.expectedCode)
+			}
+
+			if test.expectedBody != "" && rr.Body.String() != test.expectedBody {
+				t.Errorf("did not get expected response: %s", rr.Body.String())
+			}
+
+			if len(m.Queue["locations"]) != test.expectQueued {
+				t.Errorf("was expecting %d entries in queue, got %d", test.expectQueued, len(m.Queue["locations"]))
+			}
+
+			if test.expectedCode == http.StatusMethodNotAllowed && rr.Header().Get("Allow") != "GET, PATCH" {
+				t.Errorf("was expecting Allow header with GET, PATCH, got %q", rr.Header().Get("Allow"))
+			}
+		})
+	}
+}
+
+func TestConfigValidateDuplicateRoute(t *testing.T) {
+	config := Config{
+		Urls: []URL{
+			{
+				Method: "GET",
+				Path:   "/drivers/{id}",
+				HTTP:   &HTTP{Host: "zombie-driver"},
+			},
+			{
+				Method: "get",
+				Path:   "/drivers/{id}",
+				HTTP:   &HTTP{Host: "other-service"},
+			},
+		},
+	}
+
+	if err := config.Validate(); err == nil {
+		t.Error("was expecting an error for a duplicate method and path")
+	}
+}
+
 // from : https://github.com/romanyx/api_client_testing/blob/master/client_test.go
+// test that the request, the upstream and the response carry the same trace ID
+func TestTraceID(t *testing.T) {
+	upstreamIDs := make(chan string, 1)
+	client, close := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamIDs <- r.Header.Get(common.TraceIDHeader)
+	}))
+	defer close()
+
+	m := &MockQueue{Queue: map[string][][]byte{}, Err: errors.New("broker is down")}
+	r, _ := NewRequestHandler(m, client, mux.NewRouter())
+	r.Gateway(Config{
+		Urls: []URL{
+			{Method: "GET", Path: "/drivers/{id}", HTTP: &HTTP{Host: "zombie-driver"}},
+			{Method: "PATCH", Path: "/drivers/{id}/locations", Nsq: &Topic{Topic: "locations"}},
+		},
+	})
+
+	tests := []struct {
+		name     string
+		method   string
+		headers  map[string]string
+		expected string
+	}{
+		{name: "trace of the client", method: "GET", headers: map[string]string{"traceparent": testTraceparent}, expected: testTraceID},
+		// An X-Trace-Id that is not the ID of a trace is replaced by the one of the new trace
+		{name: "new trace", method: "GET", headers: map[string]string{common.TraceIDHeader: "client-trace"}},
+		{name: "problem", method: "PATCH", headers: map[string]string{"traceparent": testTraceparent}, expected: testTraceID},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := "/drivers/6"
+			if test.method == "PATCH" {
+				path += "/locations"
+			}
+			req, _ := http.NewRequest(test.method, path, bytes.NewReader([]byte(`{}`)))
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+
+			ids := map[string]string{
+				"request":  req.Header.Get(common.TraceIDHeader),
+				"response": rr.Header().Get(common.TraceIDHeader),
+			}
+			if test.method == "GET" {
+				ids["upstream"] = <-upstreamIDs
+			} else {
+				p := common.Problem{}
+				if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+					t.Fatal(err)
+				}
+				ids["problem"] = p.TraceID
+			}
+
+			expected := test.expected
+			if expected == "" {
+				expected = ids["request"]
+				if expected == "client-trace" {
+					t.Error("request kept the trace ID of the client rather than the one of its trace")
+				}
+			}
+			for name, id := range ids {
+				if id == "" || id != expected {
+					t.Errorf("%s trace ID is %q, want %q (%v)", name, id, expected, ids)
+				}
+			}
+		})
+	}
+}
+
 func testingHTTPClient(handler http.Handler) (*http.Client, func()) {
 	s := httptest.NewServer(handler)
 
@@ -267,3 +769,149 @@ func testingHTTPClient(handler http.Handler) (*http.Client, func()) {
 
 	return cli, s.Close
 }
+
+// test that reloading replaces the routes and that an invalid config keeps the current ones
+func TestReload(t *testing.T) {
+	m := &MockQueue{Queue: map[string][][]byte{}}
+	r, _ := NewRequestHandler(m, &http.Client{}, mux.NewRouter())
+
+	r.Gateway(Config{
+		Urls: []URL{
+			{Method: "PATCH", Path: "/v1/locations/{id}", Nsq: &Topic{Topic: "locations"}},
+		},
+	})
+
+	valid := Config{
+		Urls: []URL{
+			{Method: "PATCH", Path: "/v2/locations/{id}", Nsq: &Topic{Topic: "locations"}},
+		},
+	}
+
+	if err := r.Reload(valid); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := Config{
+		Urls: []URL{
+			{Method: "PATCH", Path: "/v3/locations/{id}", Nsq: &Topic{Topic: "locations", Mode: "unknown"}},
+		},
+	}
+
+	if err := r.Reload(invalid); err == nil {
+		t.Error("was expecting invalid config to be rejected")
+	}
+
+	expected := map[string]int{
+		"/v1/locations/1": http.StatusNotFound,
+		"/v2/locations/1": http.StatusAccepted,
+		"/v3/locations/1": http.StatusNotFound,
+	}
+
+	for path, code := range expected {
+		req, err := http.NewRequest("PATCH", path, bytes.NewReader([]byte(`{}`)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+
+		if rr.Code != code {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", path, rr.Code, code)
+		}
+	}
+}
+
+func TestSyncHandlerRetry(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		expectedCode  int
+		expectedCalls int
+	}{
+		{
+			name:          "idempotent method is retried",
+			method:        "GET",
+			expectedCode:  http.StatusOK,
+			expectedCalls: 3,
+		},
+		{
+			name:          "other methods are not",
+			method:        "POST",
+			expectedCode:  http.StatusServiceUnavailable,
+			expectedCalls: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			client, close := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if body, _ := ioutil.ReadAll(r.Body); string(body) != `{"id":1}` {
+					t.Errorf("attempt %d got body %q", calls, body)
+				}
+				if calls < 3 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer close()
+
+			r, _ := NewRequestHandler(&MockQueue{}, client, mux.NewRouter())
+			r.Gateway(Config{
+				Urls: []URL{
+					{
+						Method: test.method,
+						Path:   "/drivers/{id}",
+						HTTP: &HTTP{
+							Host:  "zombie-driver",
+							Retry: &Retry{Attempts: 2, Backoff: time.Millisecond},
+						},
+					},
+				},
+			})
+
+			req, _ := http.NewRequest(test.method, "/drivers/1", bytes.NewReader([]byte(`{"id":1}`)))
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+
+			if rr.Code != test.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, test.expectedCode)
+			}
+			if calls != test.expectedCalls {
+				t.Errorf("upstream was called %d times, want %d", calls, test.expectedCalls)
+			}
+		})
+	}
+}
+
+func TestSyncHandlerTimeout(t *testing.T) {
+	deadlines := make(chan string, 1)
+	client, close := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadlines <- r.Header.Get(common.DeadlineHeader)
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer close()
+
+	r, _ := NewRequestHandler(&MockQueue{}, client, mux.NewRouter())
+	r.Gateway(Config{
+		Urls: []URL{
+			{Method: "GET", Path: "/drivers/{id}", HTTP: &HTTP{Host: "zombie-driver", Timeout: 50 * time.Millisecond}},
+		},
+	})
+
+	req, _ := http.NewRequest("GET", "/drivers/1", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusGatewayTimeout)
+	}
+
+	deadline, err := strconv.Atoi(<-deadlines)
+	if err != nil || deadline <= 0 || deadline > 50 {
+		t.Errorf("upstream got an unexpected deadline %d (%v)", deadline, err)
+	}
+}
@@ -0,0 +1,241 @@
+package domain
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Signing algorithms of the tokens accepted by the jwt authenticator
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmRS256 = "RS256"
+)
+
+var (
+	errMalformedToken = errors.New("malformed token")
+	errInvalidToken   = errors.New("invalid token signature")
+	errExpiredToken   = errors.New("token is expired")
+)
+
+// tokenHeader is the JOSE header of a token
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// jwk is an RSA key of a JWKS file, see RFC 7517
+type jwk struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+}
+
+// tokenVerifier checks the signature and the validity of JSON Web Tokens
+type tokenVerifier struct {
+	// secret verifies HS256 tokens
+	secret []byte
+	// keys verify RS256 tokens by key ID
+	keys     map[string]*rsa.PublicKey
+	issuer   string
+	audience string
+	now      func() time.Time
+}
+
+// loadJWKS reads the RSA keys of a JWKS file, keys of other types are ignored
+func loadJWKS(filename string) (map[string]*rsa.PublicKey, error) {
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(source, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.KeyType != "RSA" {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", k.KeyID, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", k.KeyID, err)
+		}
+
+		keys[k.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no RSA key in %s", filename)
+	}
+	return keys, nil
+}
+
+// verify returns the claims of token once its signature, expiry, issuer and audience are checked
+func (v tokenVerifier) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformedToken
+	}
+
+	header := tokenHeader{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errMalformedToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformedToken
+	}
+
+	// The algorithm comes from the token, only the ones a key is configured for are accepted
+	signed := []byte(parts[0] + "." + parts[1])
+	switch {
+	case header.Algorithm == AlgorithmHS256 && v.secret != nil:
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, errInvalidToken
+		}
+
+	case header.Algorithm == AlgorithmRS256 && v.keys != nil:
+		key, ok := v.keys[header.KeyID]
+		if !ok && header.KeyID == "" && len(v.keys) == 1 {
+			for _, k := range v.keys {
+				key, ok = k, true
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", header.KeyID)
+		}
+
+		hash := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+			return nil, errInvalidToken
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Algorithm)
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errMalformedToken
+	}
+
+	now := v.now().Unix()
+	exp, ok, err := numericClaim(claims, "exp")
+	if err != nil {
+		return nil, err
+	}
+	if ok && now >= exp {
+		return nil, errExpiredToken
+	}
+	nbf, ok, err := numericClaim(claims, "nbf")
+	if err != nil {
+		return nil, err
+	}
+	if ok && now < nbf {
+		return nil, errors.New("token is not valid yet")
+	}
+
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return nil, errors.New("unexpected token issuer")
+	}
+	if v.audience != "" && !claimContains(claims["aud"], v.audience) {
+		return nil, errors.New("unexpected token audience")
+	}
+
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// numericClaim returns a date claim such as exp as unix seconds, ok is false when the token has no such
+// claim. A claim that is not a number fails rather than be skipped, which would leave the token valid forever.
+func numericClaim(claims map[string]interface{}, name string) (int64, bool, error) {
+	claim, ok := claims[name]
+	if !ok {
+		return 0, false, nil
+	}
+
+	n, ok := claim.(json.Number)
+	if !ok {
+		return 0, false, fmt.Errorf("claim %s is not a number", name)
+	}
+
+	f, err := n.Float64()
+	if err != nil {
+		return 0, false, fmt.Errorf("claim %s is not a number", name)
+	}
+	return int64(f), true, nil
+}
+
+// claimValues returns the values of a claim that is either a space separated string or an array
+func claimValues(claim interface{}) []string {
+	switch c := claim.(type) {
+	case string:
+		return strings.Fields(c)
+	case []interface{}:
+		values := make([]string, 0, len(c))
+		for _, v := range c {
+			values = append(values, claimString(v))
+		}
+		return values
+	}
+	return nil
+}
+
+// claimContains reports whether claim is value or an array holding it
+func claimContains(claim interface{}, value string) bool {
+	if s, ok := claim.(string); ok {
+		return s == value
+	}
+
+	for _, v := range claimValues(claim) {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// claimString returns a string or number claim as a string, so it can be compared to a path variable
+func claimString(claim interface{}) string {
+	switch c := claim.(type) {
+	case string:
+		return c
+	case json.Number:
+		return c.String()
+	}
+	return ""
+}
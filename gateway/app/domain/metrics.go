@@ -0,0 +1,30 @@
+package domain
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// breakerStateValues is what breakerState is set to for each state of a breaker
+var breakerStateValues = map[string]float64{
+	BreakerClosed:   0,
+	BreakerHalfOpen: 1,
+	BreakerOpen:     2,
+}
+
+var (
+	breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gateway_circuit_breaker_state",
+		Help: "State of the circuit breaker of a route: 0 closed, 1 half-open, 2 open.",
+	}, []string{"route"})
+
+	breakerTrips = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_circuit_breaker_trips_total",
+		Help: "Times the circuit breaker of a route opened.",
+	}, []string{"route"})
+
+	breakerRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_circuit_breaker_rejected_total",
+		Help: "Calls failed fast by the circuit breaker of a route.",
+	}, []string{"route"})
+)
@@ -0,0 +1,218 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+)
+
+const (
+	headerForwardedFor   = "X-Forwarded-For"
+	headerForwardedHost  = "X-Forwarded-Host"
+	headerForwardedProto = "X-Forwarded-Proto"
+)
+
+// hopByHopHeaders only make sense for a single connection and are never forwarded, see RFC 7230 section 6.1
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// syncRoute is what the handler of an http route needs to proxy a request
+type syncRoute struct {
+	balancer        *Balancer
+	timeout         time.Duration
+	retry           *Retry
+	requestHeaders  *HeaderFilter
+	responseHeaders *HeaderFilter
+
+	target      string
+	stripPrefix string
+	queryRename map[string]string
+}
+
+// upstreamPath returns the path r is sent to, built from the target template or the request path
+func (s syncRoute) upstreamPath(r *http.Request) string {
+	if s.target != "" {
+		vars := mux.Vars(r)
+		return pathVariable.ReplaceAllStringFunc(s.target, func(variable string) string {
+			return url.PathEscape(vars[pathVariable.FindStringSubmatch(variable)[1]])
+		})
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, s.stripPrefix)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// upstreamQuery returns the query string of r with its parameters renamed
+func (s syncRoute) upstreamQuery(r *http.Request) string {
+	if len(s.queryRename) == 0 {
+		return r.URL.RawQuery
+	}
+
+	query := r.URL.Query()
+	renamed := url.Values{}
+	for name, values := range query {
+		if to, ok := s.queryRename[name]; ok {
+			name = to
+		}
+		renamed[name] = append(renamed[name], values...)
+	}
+	return renamed.Encode()
+}
+
+// upstreamURL returns the URL of path on host, host may start with a http:// or https:// scheme
+func upstreamURL(host, path string) string {
+	if strings.HasPrefix(host, "http://") || strings.HasPrefix(host, "https://") {
+		return strings.TrimSuffix(host, "/") + path
+	}
+	return "http://" + host + path
+}
+
+// proxy sends r to host, with body instead of the body of r when it is not nil. The client headers are
+// forwarded, along with the X-Forwarded-* headers, the traceID and the time left before ctx is done.
+func (s *RequestHandler) proxy(ctx context.Context, route syncRoute, host string, r *http.Request, body []byte, traceID string) (*http.Response, error) {
+	var reader io.Reader = r.Body
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(r.Method, upstreamURL(host, route.upstreamPath(r)), reader)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.URL.RawQuery = route.upstreamQuery(r)
+
+	if body == nil {
+		req.ContentLength = r.ContentLength
+	}
+
+	req.Header = r.Header.Clone()
+	removeHopByHopHeaders(req.Header)
+	route.requestHeaders.apply(req.Header)
+
+	setForwardedHeaders(req.Header, r)
+
+	// Pass the traceID and the authenticated caller downstream
+	req.Header.Set(common.TraceIDHeader, traceID)
+	if subject := r.Header.Get(common.SubjectHeader); subject != "" {
+		req.Header.Set(common.SubjectHeader, subject)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(common.DeadlineHeader, strconv.FormatInt(time.Until(deadline).Milliseconds(), 10))
+	}
+
+	return s.client.Do(req)
+}
+
+// copyResponse writes the status, headers and body of res to w. The body is streamed and flushed
+// as it comes so that long responses are not held back by the gateway.
+func copyResponse(w http.ResponseWriter, res *http.Response, filter *HeaderFilter) error {
+	header := res.Header.Clone()
+	removeHopByHopHeaders(header)
+	filter.apply(header)
+
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(res.StatusCode)
+
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers, including the ones listed in Connection
+func removeHopByHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// setForwardedHeaders tells the upstream who the original client is and how it reached the gateway
+func setForwardedHeaders(h http.Header, r *http.Request) {
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := h.Get(headerForwardedFor); prior != "" {
+			ip = prior + ", " + ip
+		}
+		h.Set(headerForwardedFor, ip)
+	}
+
+	h.Set(headerForwardedHost, r.Host)
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	h.Set(headerForwardedProto, proto)
+}
+
+// apply removes from h the headers f does not let through, a nil filter lets everything through
+func (f *HeaderFilter) apply(h http.Header) {
+	if f == nil {
+		return
+	}
+
+	if len(f.Allow) > 0 {
+		allowed := map[string]bool{}
+		for _, name := range f.Allow {
+			allowed[http.CanonicalHeaderKey(name)] = true
+		}
+		for name := range h {
+			if !allowed[name] {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, name := range f.Deny {
+		h.Del(name)
+	}
+}
@@ -0,0 +1,194 @@
+package domain
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/gorilla/mux"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+)
+
+func TestSyncHandlerHeaders(t *testing.T) {
+	upstreamHeaders := make(chan http.Header, 1)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeaders <- r.Header
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-Internal-Version", "4")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"id":1}`))
+	}))
+	defer ts.Close()
+
+	r, _ := NewRequestHandler(&MockQueue{}, ts.Client(), mux.NewRouter())
+	r.Gateway(Config{
+		Urls: []URL{
+			{
+				Method: "GET",
+				Path:   "/drivers/{id}",
+				HTTP: &HTTP{
+					Host:            ts.URL,
+					RequestHeaders:  &HeaderFilter{Deny: []string{"Cookie"}},
+					ResponseHeaders: &HeaderFilter{Deny: []string{"X-Internal-Version"}},
+				},
+			},
+		},
+	})
+
+	req, _ := http.NewRequest("GET", "/drivers/1?fields=id", nil)
+	req.RemoteAddr = "10.0.0.2:5000"
+	req.Host = "api.example.com"
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set("traceparent", testTraceparent)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"id":1}` {
+		t.Fatalf("got %d %q", rr.Code, rr.Body.String())
+	}
+
+	expected := map[string]string{
+		"Accept":             "application/json",
+		"Cookie":             "",
+		"Connection":         "",
+		"X-Hop":              "",
+		"X-Forwarded-For":    "10.0.0.1, 10.0.0.2",
+		"X-Forwarded-Host":   "api.example.com",
+		"X-Forwarded-Proto":  "http",
+		common.TraceIDHeader: testTraceID,
+	}
+	headers := <-upstreamHeaders
+	for name, value := range expected {
+		if got := headers.Get(name); got != value {
+			t.Errorf("upstream got %s %q, want %q", name, got, value)
+		}
+	}
+
+	got := map[string]string{
+		"Content-Type":       rr.Header().Get("Content-Type"),
+		"Keep-Alive":         rr.Header().Get("Keep-Alive"),
+		"X-Internal-Version": rr.Header().Get("X-Internal-Version"),
+	}
+	if diff := deep.Equal(got, map[string]string{"Content-Type": "application/json", "Keep-Alive": "", "X-Internal-Version": ""}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestHeaderFilter(t *testing.T) {
+	h := http.Header{}
+	h.Set("Accept", "application/json")
+	h.Set("Authorization", "Bearer token")
+	h.Set("X-Debug", "1")
+
+	filter := &HeaderFilter{Allow: []string{"accept", "authorization"}, Deny: []string{"Authorization"}}
+	filter.apply(h)
+
+	if diff := deep.Equal(h, http.Header{"Accept": {"application/json"}}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestSyncHandlerRewrite(t *testing.T) {
+	tests := []struct {
+		name          string
+		path          string
+		http          HTTP
+		request       string
+		expectedPath  string
+		expectedQuery string
+	}{
+		{
+			name:          "request path",
+			path:          "/drivers/{id}",
+			http:          HTTP{},
+			request:       "/drivers/1?minutes=5",
+			expectedPath:  "/drivers/1",
+			expectedQuery: "minutes=5",
+		},
+		{
+			name:          "target template",
+			path:          "/v2/drivers/{id}/status",
+			http:          HTTP{Target: "/drivers/{id}"},
+			request:       "/v2/drivers/1/status",
+			expectedPath:  "/drivers/1",
+			expectedQuery: "",
+		},
+		{
+			name:          "target template with a pattern",
+			path:          "/v2/drivers/{id:[0-9]+}",
+			http:          HTTP{Target: "/internal/{id}/zombie"},
+			request:       "/v2/drivers/42",
+			expectedPath:  "/internal/42/zombie",
+			expectedQuery: "",
+		},
+		{
+			name:          "strip prefix",
+			path:          "/v2/drivers/{id}",
+			http:          HTTP{StripPrefix: "/v2"},
+			request:       "/v2/drivers/1",
+			expectedPath:  "/drivers/1",
+			expectedQuery: "",
+		},
+		{
+			name:          "query rename",
+			path:          "/drivers/{id}",
+			http:          HTTP{QueryRename: map[string]string{"window": "minutes"}},
+			request:       "/drivers/1?window=5&unit=km",
+			expectedPath:  "/drivers/1",
+			expectedQuery: "minutes=5&unit=km",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			upstream := make(chan *http.Request, 1)
+			client, close := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstream <- r
+			}))
+			defer close()
+
+			test.http.Host = "zombie-driver"
+			config := Config{Urls: []URL{{Method: "GET", Path: test.path, HTTP: &test.http}}}
+			if err := config.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			r, _ := NewRequestHandler(&MockQueue{}, client, mux.NewRouter())
+			r.Gateway(config)
+
+			req, _ := http.NewRequest("GET", test.request, nil)
+			r.ServeHTTP(httptest.NewRecorder(), req)
+
+			got := <-upstream
+			if got.URL.Path != test.expectedPath || got.URL.RawQuery != test.expectedQuery {
+				t.Errorf("upstream got %s?%s, want %s?%s", got.URL.Path, got.URL.RawQuery, test.expectedPath, test.expectedQuery)
+			}
+		})
+	}
+}
+
+func TestConfigValidateRewrite(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		http HTTP
+	}{
+		{name: "unknown variable", path: "/v2/drivers/{id}", http: HTTP{Host: "zombie-driver", Target: "/drivers/{driver}"}},
+		{name: "prefix of another path", path: "/v2/drivers/{id}", http: HTTP{Host: "zombie-driver", StripPrefix: "/v3"}},
+		{name: "target and prefix", path: "/v2/drivers/{id}", http: HTTP{Host: "zombie-driver", Target: "/drivers/{id}", StripPrefix: "/v2"}},
+	}
+
+	for _, test := range tests {
+		config := Config{Urls: []URL{{Method: "GET", Path: test.path, HTTP: &test.http}}}
+		if err := config.Validate(); err == nil {
+			t.Errorf("%s: was expecting an error", test.name)
+		}
+	}
+}
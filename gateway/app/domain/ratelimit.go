@@ -0,0 +1,217 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/mux"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/rs/zerolog/log"
+)
+
+// Rate limit headers sent with every response of a limited route
+const (
+	headerRateLimitLimit     = "X-RateLimit-Limit"
+	headerRateLimitRemaining = "X-RateLimit-Remaining"
+)
+
+// sweepInterval is how often the memory limiter drops the buckets that are full again
+const sweepInterval = time.Minute
+
+// LimitResult is the outcome of taking a token from a bucket
+type LimitResult struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is how long until the next token when the request is not allowed
+	RetryAfter time.Duration
+}
+
+// Limiter keeps a token bucket per key
+type Limiter interface {
+	Take(ctx context.Context, key string, limit RateLimit) (LimitResult, error)
+}
+
+// bucket is the state of a token bucket at a point in time
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// refill is how long the bucket takes to fill up completely
+	refill time.Duration
+}
+
+// MemoryLimiter keeps the buckets in memory, each replica of the gateway enforces its own limits
+type MemoryLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{buckets: map[string]*bucket{}, now: time.Now, lastSweep: time.Now()}
+}
+
+// Take refills the bucket of key for the time elapsed since it was last used and takes a token from it
+func (m *MemoryLimiter) Take(ctx context.Context, key string, limit RateLimit) (LimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	capacity, rate := float64(limit.Capacity()), limit.TokensPerSecond()
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now, refill: time.Duration(capacity / rate * float64(time.Second))}
+		m.buckets[key] = b
+	}
+
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	result := LimitResult{Allowed: b.tokens >= 1}
+	if result.Allowed {
+		b.tokens--
+	} else {
+		result.RetryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	result.Remaining = int(b.tokens)
+
+	if now.Sub(m.lastSweep) >= sweepInterval {
+		m.sweep(now)
+	}
+
+	return result, nil
+}
+
+// sweep drops the buckets that refilled completely since they were last used, mu must be held
+func (m *MemoryLimiter) sweep(now time.Time) {
+	m.lastSweep = now
+	for key, b := range m.buckets {
+		if now.Sub(b.last) >= b.refill {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// takeScript is the token bucket algorithm of MemoryLimiter run atomically by redis.
+// The bucket expires once it is full again, as it would be created full.
+var takeScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+
+redis.call('HMSET', KEYS[1], 'tokens', tokens, 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(capacity / rate))
+
+return {allowed, tostring(tokens)}
+`)
+
+// RedisLimiter keeps the buckets in redis so that every replica of the gateway enforces the same limits
+type RedisLimiter struct {
+	client *redis.Client
+	now    func() time.Time
+}
+
+func NewRedisLimiter(client *redis.Client) *RedisLimiter {
+	return &RedisLimiter{client: client, now: time.Now}
+}
+
+func (l *RedisLimiter) Take(ctx context.Context, key string, limit RateLimit) (LimitResult, error) {
+	// Times are in milliseconds in redis
+	rate := limit.TokensPerSecond() / 1000
+	now := l.now().UnixNano() / int64(time.Millisecond)
+
+	res, err := takeScript.Run(l.client.WithContext(ctx), []string{"ratelimit:" + key}, limit.Capacity(), rate, now).Result()
+	if err != nil {
+		return LimitResult{}, err
+	}
+
+	values, ok := res.([]interface{})
+	if !ok || len(values) != 2 {
+		return LimitResult{}, fmt.Errorf("unexpected rate limit script result %v", res)
+	}
+
+	allowed, _ := values[0].(int64)
+	tokensValue, _ := values[1].(string)
+	tokens, err := strconv.ParseFloat(tokensValue, 64)
+	if err != nil {
+		return LimitResult{}, err
+	}
+
+	result := LimitResult{Allowed: allowed == 1, Remaining: int(tokens)}
+	if !result.Allowed {
+		result.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Millisecond))
+	}
+	return result, nil
+}
+
+// rateLimitKey returns what the requests of r are counted by
+func rateLimitKey(limit RateLimit, r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	switch limit.Key {
+	case RateKeyIP:
+		return "ip:" + ip
+	case RateKeyAPIKey:
+		// The route is authenticated, so the subject is the caller's and not a value anyone can make up
+		return "subject:" + r.Header.Get(common.SubjectHeader)
+	}
+
+	variable := limit.KeyVariable()
+	return variable + ":" + mux.Vars(r)[variable]
+}
+
+// rateLimit answers 429 once the bucket of the caller is empty. The limiter failing lets the request
+// through, an unavailable redis must not take the gateway down with it.
+func rateLimit(route string, limit RateLimit, limiter Limiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		traceID := common.ExtractTraceIDFromReq(r)
+		key := rateLimitKey(limit, r)
+
+		result, err := limiter.Take(r.Context(), route+":"+key, limit)
+		if err != nil {
+			log.Error().Err(err).Str(logTraceID, traceID).Msg("could not check rate limit, letting the request through")
+			next(w, r)
+			return
+		}
+
+		w.Header().Set(headerRateLimitLimit, strconv.Itoa(limit.Capacity()))
+		w.Header().Set(headerRateLimitRemaining, strconv.Itoa(result.Remaining))
+
+		if !result.Allowed {
+			retryAfter := int(math.Ceil(result.RetryAfter.Seconds()))
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+
+			log.Warn().Str(logTraceID, traceID).Str("route", route).Str("key", key).Msg("rate limit exceeded")
+			w.Header().Set(headerRetryAfter, strconv.Itoa(retryAfter))
+			writeError(w, http.StatusTooManyRequests, CodeRateLimited, "rate limit exceeded", traceID)
+			return
+		}
+
+		next(w, r)
+	}
+}
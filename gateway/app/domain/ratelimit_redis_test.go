@@ -0,0 +1,38 @@
+// +build integration
+
+package domain
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Make sure a redis instance is running or this test will fail
+
+func TestRedisLimiter(t *testing.T) {
+	client := redis.NewClient(&redis.Options{})
+	if _, err := client.Ping().Result(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Del("ratelimit:test:driver:6")
+
+	// Two replicas share the same bucket
+	replicas := []*RedisLimiter{NewRedisLimiter(client), NewRedisLimiter(client)}
+	limit := RateLimit{Requests: 1, Period: time.Minute, Burst: 2}
+
+	for i, expected := range []bool{true, true, false} {
+		result, err := replicas[i%2].Take(context.Background(), "test:driver:6", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Allowed != expected {
+			t.Errorf("request %d: got allowed %v want %v", i, result.Allowed, expected)
+		}
+		if !result.Allowed && (result.RetryAfter <= 0 || result.RetryAfter > time.Minute) {
+			t.Errorf("request %d: unexpected retry after %s", i, result.RetryAfter)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	l := NewMemoryLimiter()
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	limit := RateLimit{Requests: 1, Period: time.Second, Burst: 2}
+
+	for i, expected := range []bool{true, true, false} {
+		result, _ := l.Take(context.Background(), "driver:6", limit)
+		if result.Allowed != expected {
+			t.Errorf("request %d: got allowed %v want %v", i, result.Allowed, expected)
+		}
+	}
+
+	result, _ := l.Take(context.Background(), "driver:6", limit)
+	if result.RetryAfter != time.Second {
+		t.Errorf("got retry after %s, want 1s", result.RetryAfter)
+	}
+
+	// Another key has its own bucket
+	if result, _ := l.Take(context.Background(), "driver:7", limit); !result.Allowed {
+		t.Error("was expecting another key to be allowed")
+	}
+
+	now = now.Add(1500 * time.Millisecond)
+	result, _ = l.Take(context.Background(), "driver:6", limit)
+	if !result.Allowed || result.Remaining != 0 {
+		t.Errorf("was expecting a refilled token, got %+v", result)
+	}
+
+	// Full buckets are dropped
+	now = now.Add(time.Hour)
+	l.Take(context.Background(), "driver:8", limit)
+	if len(l.buckets) != 1 {
+		t.Errorf("was expecting idle buckets to be dropped, got %d buckets", len(l.buckets))
+	}
+}
+
+func TestRateLimitedRoute(t *testing.T) {
+	m := &MockQueue{Queue: map[string][][]byte{}}
+	r, _ := NewRequestHandler(m, &http.Client{}, mux.NewRouter())
+
+	r.Gateway(Config{
+		Urls: []URL{
+			{
+				Method:    "PATCH",
+				Path:      "/drivers/{id}/locations",
+				Nsq:       &Topic{Topic: "locations"},
+				RateLimit: &RateLimit{Requests: 1, Period: time.Minute, Key: "{id}"},
+			},
+		},
+	})
+
+	tests := []struct {
+		path              string
+		expectedCode      int
+		expectedRemaining string
+	}{
+		{path: "/drivers/6/locations", expectedCode: http.StatusAccepted, expectedRemaining: "0"},
+		{path: "/drivers/6/locations", expectedCode: http.StatusTooManyRequests, expectedRemaining: "0"},
+		{path: "/drivers/7/locations", expectedCode: http.StatusAccepted, expectedRemaining: "0"},
+	}
+
+	for i, test := range tests {
+		req, _ := http.NewRequest("PATCH", test.path, bytes.NewReader([]byte(`{}`)))
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+
+		if rr.Code != test.expectedCode {
+			t.Errorf("request %d: got status %v want %v", i, rr.Code, test.expectedCode)
+		}
+		if rr.Header().Get(headerRateLimitLimit) != "1" || rr.Header().Get(headerRateLimitRemaining) != test.expectedRemaining {
+			t.Errorf("request %d: unexpected rate limit headers %v", i, rr.Header())
+		}
+		if test.expectedCode == http.StatusTooManyRequests && rr.Header().Get(headerRetryAfter) != "60" {
+			t.Errorf("request %d: got Retry-After %q want 60", i, rr.Header().Get(headerRetryAfter))
+		}
+	}
+
+	if len(m.Queue["locations"]) != 2 {
+		t.Errorf("was expecting 2 published messages, got %d", len(m.Queue["locations"]))
+	}
+}
+
+func TestConfigValidateRateLimit(t *testing.T) {
+	keys, err := ioutil.TempFile("", "keys*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keys.Name())
+	keys.WriteString("keys:\n  - key: partner-key\n    subject: partner-1\n")
+	keys.Close()
+
+	secret, err := ioutil.TempFile("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(secret.Name())
+	secret.WriteString("driver-app-secret")
+	secret.Close()
+
+	authenticators := map[string]Authenticator{
+		"partners": {Type: AuthAPIKey, KeysFile: keys.Name()},
+		"drivers":  {Type: AuthJWT, SecretFile: secret.Name()},
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		auth    *RouteAuth
+		limit   RateLimit
+		wantErr bool
+	}{
+		{name: "no requests", limit: RateLimit{Requests: 0, Period: time.Second, Key: RateKeyIP}, wantErr: true},
+		{name: "ip", limit: RateLimit{Requests: 1, Period: time.Second, Key: RateKeyIP}},
+		{
+			name:  "path variable",
+			auth:  &RouteAuth{Authenticators: []string{"drivers"}, Bind: map[string]string{"id": "sub"}},
+			limit: RateLimit{Requests: 1, Period: time.Second, Key: "{id}"},
+		},
+		{
+			name:  "path variable with a pattern",
+			path:  "/drivers/{id:[0-9]+}",
+			auth:  &RouteAuth{Authenticators: []string{"drivers"}, Bind: map[string]string{"id": "sub"}},
+			limit: RateLimit{Requests: 1, Period: time.Second, Key: "{id}"},
+		},
+		{name: "path variable without auth", limit: RateLimit{Requests: 1, Period: time.Second, Key: "{id}"}, wantErr: true},
+		{name: "unknown path variable", limit: RateLimit{Requests: 1, Period: time.Second, Key: "{driver}"}, wantErr: true},
+		{name: "prefix of a path variable", limit: RateLimit{Requests: 1, Period: time.Second, Key: "{i}"}, wantErr: true},
+		{name: "unknown key", limit: RateLimit{Requests: 1, Period: time.Second, Key: "user"}, wantErr: true},
+		{name: "api-key without auth", limit: RateLimit{Requests: 1, Period: time.Second, Key: RateKeyAPIKey}, wantErr: true},
+		{
+			name:    "api-key without an api-key authenticator",
+			auth:    &RouteAuth{Authenticators: []string{"drivers"}},
+			limit:   RateLimit{Requests: 1, Period: time.Second, Key: RateKeyAPIKey},
+			wantErr: true,
+		},
+		{
+			name:  "api-key",
+			auth:  &RouteAuth{Authenticators: []string{"drivers", "partners"}},
+			limit: RateLimit{Requests: 1, Period: time.Second, Key: RateKeyAPIKey},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := test.path
+			if path == "" {
+				path = "/drivers/{id}"
+			}
+			config := Config{
+				Authenticators: authenticators,
+				Urls:           []URL{{Method: "GET", Path: path, HTTP: &HTTP{Host: "zombie-driver"}, Auth: test.auth, RateLimit: &test.limit}},
+			}
+			if err := config.Validate(); (err != nil) != test.wantErr {
+				t.Errorf("was expecting an error: %t, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		headers map[string]string
+		want    string
+	}{
+		{name: "ip", key: RateKeyIP, want: "ip:192.0.2.1"},
+		{name: "path variable", key: "{id}", want: "id:6"},
+		{
+			name:    "api-key counts by subject",
+			key:     RateKeyAPIKey,
+			headers: map[string]string{common.SubjectHeader: "partner-1", DefaultAPIKeyHeader: "made-up"},
+			want:    "subject:partner-1",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/drivers/6", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			for name, value := range test.headers {
+				r.Header.Set(name, value)
+			}
+			r = mux.SetURLVars(r, map[string]string{"id": "6"})
+
+			if got := rateLimitKey(RateLimit{Key: test.key}, r); got != test.want {
+				t.Errorf("got key %q, want %q", got, test.want)
+			}
+		})
+	}
+}
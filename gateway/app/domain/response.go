@@ -0,0 +1,77 @@
+package domain
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/rs/zerolog/log"
+)
+
+// Error codes returned in ErrorResponse
+const (
+	CodeInvalidBody         = "invalid_body"
+	CodeBodyTooLarge        = "body_too_large"
+	CodeNotFound            = "not_found"
+	CodeMethodNotAllowed    = "method_not_allowed"
+	CodeQueueUnavailable    = "queue_unavailable"
+	CodeInternalError       = common.CodeInternalError
+	CodeUpstreamUnavailable = "upstream_unavailable"
+	CodeCircuitOpen         = "circuit_open"
+	CodeUpstreamTimeout     = "upstream_timeout"
+	CodeBadGateway          = "bad_gateway"
+	CodeInvalidRequest      = common.CodeInvalidRequest
+	CodeUnauthorized        = "unauthorized"
+	CodeForbidden           = "forbidden"
+	CodeRateLimited         = "rate_limited"
+)
+
+const (
+	contentTypeJSON   = "application/json"
+	contentTypeYAML   = "application/yaml"
+	headerContentType = "Content-Type"
+	headerAllow       = "Allow"
+	headerRetryAfter  = "Retry-After"
+
+	// MaxBodyBytes is the largest request body accepted by async routes
+	MaxBodyBytes = 1 << 20
+)
+
+// AcceptedResponse is returned by async routes once the message is handed over to the queue
+type AcceptedResponse struct {
+	MessageID string `json:"message_id"`
+	TraceID   string `json:"trace_id"`
+}
+
+// ErrorResponse is the body of every error returned by the gateway itself, an RFC 7807 problem
+type ErrorResponse = common.Problem
+
+// writeJSON writes v with status, the traceID is returned in a header as well
+func writeJSON(w http.ResponseWriter, status int, traceID string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not marshal response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(headerContentType, contentTypeJSON)
+	w.Header().Set(common.TraceIDHeader, traceID)
+	w.WriteHeader(status)
+
+	if _, err := w.Write(b); err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not write response")
+	}
+}
+
+// writeCircuitOpen fails fast with a 503 telling the client when to try again
+func writeCircuitOpen(w http.ResponseWriter, err OpenError, traceID string) {
+	w.Header().Set(headerRetryAfter, strconv.Itoa(err.RetryAfterSeconds()))
+	writeError(w, http.StatusServiceUnavailable, CodeCircuitOpen, err.Error(), traceID)
+}
+
+// writeError writes an ErrorResponse with status
+func writeError(w http.ResponseWriter, status int, code, message, traceID string) {
+	common.WriteError(w, status, code, message, traceID)
+}
@@ -0,0 +1,88 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/rs/zerolog/log"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// FieldError is a field of the request that does not match the schema of the route
+type FieldError = common.FieldError
+
+// schemaDocument is what the schema of a route validates: the path variables and the JSON body
+type schemaDocument struct {
+	Path map[string]string `json:"path"`
+	Body json.RawMessage   `json:"body"`
+}
+
+// loadSchema compiles the JSON Schema in filename
+func loadSchema(filename string) (*gojsonschema.Schema, error) {
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return gojsonschema.NewSchema(gojsonschema.NewBytesLoader(source))
+}
+
+// validateSchema answers 400 with the fields in error when the request does not match schema, the
+// request is passed to next otherwise. The body is read to be validated and handed over to next as it was.
+func validateSchema(schema *gojsonschema.Schema, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		traceID := common.ExtractTraceIDFromReq(r)
+
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxBodyBytes+1))
+		if err != nil {
+			log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request body")
+			writeError(w, http.StatusBadRequest, CodeInvalidBody, "could not read body", traceID)
+			return
+		}
+
+		if len(body) > MaxBodyBytes {
+			writeError(w, http.StatusRequestEntityTooLarge, CodeBodyTooLarge,
+				fmt.Sprintf("body must not exceed %d bytes", MaxBodyBytes), traceID)
+			return
+		}
+
+		if len(body) > 0 && !json.Valid(body) {
+			writeError(w, http.StatusBadRequest, CodeInvalidBody, "body is not valid JSON", traceID)
+			return
+		}
+
+		document := schemaDocument{Path: mux.Vars(r), Body: body}
+		if len(body) == 0 {
+			document.Body = json.RawMessage("null")
+		}
+
+		result, err := schema.Validate(gojsonschema.NewGoLoader(document))
+		if err != nil {
+			log.Error().Err(err).Str(logTraceID, traceID).Msg("could not validate request")
+			writeError(w, http.StatusInternalServerError, CodeInternalError, "could not validate request", traceID)
+			return
+		}
+
+		if !result.Valid() {
+			fields := make([]FieldError, 0, len(result.Errors()))
+			for _, e := range result.Errors() {
+				fields = append(fields, FieldError{Field: e.Field(), Message: e.Description()})
+			}
+
+			p := common.NewProblem(http.StatusBadRequest, CodeInvalidRequest, "request does not match the schema of the route", traceID)
+			p.Fields = fields
+			common.WriteProblem(w, p)
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		next(w, r)
+	}
+}
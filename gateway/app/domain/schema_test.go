@@ -0,0 +1,111 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/gorilla/mux"
+)
+
+func TestValidateSchema(t *testing.T) {
+	tests := []struct {
+		name           string
+		path           string
+		body           string
+		expectedCode   int
+		expectedFields []string
+	}{
+		{
+			name:         "valid ping",
+			path:         "/drivers/6/locations",
+			body:         `{"latitude": 28.864193, "longitude": 9.550498}`,
+			expectedCode: http.StatusAccepted,
+		},
+		{
+			name:           "driver ID is not numeric",
+			path:           "/drivers/abc/locations",
+			body:           `{"latitude": 28.864193, "longitude": 9.550498}`,
+			expectedCode:   http.StatusBadRequest,
+			expectedFields: []string{"path.id"},
+		},
+		{
+			name:           "missing and out of range coordinates",
+			path:           "/drivers/6/locations",
+			body:           `{"latitude": 128.8}`,
+			expectedCode:   http.StatusBadRequest,
+			expectedFields: []string{"body", "body.latitude"},
+		},
+		{
+			name:           "missing body",
+			path:           "/drivers/6/locations",
+			body:           ``,
+			expectedCode:   http.StatusBadRequest,
+			expectedFields: []string{"body"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &MockQueue{Queue: map[string][][]byte{}}
+			r, _ := NewRequestHandler(m, &http.Client{}, mux.NewRouter())
+
+			config := Config{
+				Urls: []URL{
+					{Method: "PATCH", Path: "/drivers/{id}/locations", Nsq: &Topic{Topic: "locations"}, Schema: "../../schemas/location.json"},
+				},
+			}
+			if err := config.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			r.Gateway(config)
+
+			req, _ := http.NewRequest("PATCH", test.path, bytes.NewReader([]byte(test.body)))
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+
+			if rr.Code != test.expectedCode {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, test.expectedCode)
+			}
+
+			if test.expectedCode == http.StatusAccepted {
+				if len(m.Queue["locations"]) != 1 {
+					t.Error("valid ping was not published")
+				}
+				return
+			}
+
+			if len(m.Queue["locations"]) != 0 {
+				t.Error("invalid ping was published")
+			}
+
+			response := ErrorResponse{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+
+			fields := []string{}
+			for _, f := range response.Fields {
+				fields = append(fields, f.Field)
+			}
+			if diff := deep.Equal(fields, test.expectedFields); diff != nil {
+				t.Errorf("%v: %+v", diff, response.Fields)
+			}
+		})
+	}
+}
+
+func TestConfigValidateSchema(t *testing.T) {
+	config := Config{
+		Urls: []URL{
+			{Method: "GET", Path: "/drivers/{id}", HTTP: &HTTP{Host: "zombie-driver"}, Schema: "unknown.json"},
+		},
+	}
+
+	if err := config.Validate(); err == nil {
+		t.Error("was expecting a missing schema to be rejected")
+	}
+}
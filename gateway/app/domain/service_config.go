@@ -0,0 +1,36 @@
+package domain
+
+import "time"
+
+// ServiceConfig holds the settings of the gateway itself, loaded by common/config from the environment and
+// the command line. The routes are read from RoutesFile, which the admin API writes back to.
+type ServiceConfig struct {
+	KafkaBrokers []string `yaml:"kafka-brokers" default:"kafka1:9092" validate:"min=1"`
+	// MaxInFlight is the number of messages the async producer buffers before rejecting new ones
+	MaxInFlight int `yaml:"max-in-flight" default:"1000" validate:"min=1"`
+
+	// Messages of the store-and-forward routes that cannot be published are kept in the outbox
+	// and replayed in order, with the sync producer, once the broker is back
+	OutboxDir            string        `yaml:"outbox-dir" default:"/var/spool/gateway" validate:"required"`
+	OutboxMaxMessages    int           `yaml:"outbox-max-messages" default:"100000" validate:"min=1"`
+	OutboxMaxBytes       int64         `yaml:"outbox-max-bytes" default:"536870912" validate:"min=1"`
+	OutboxReplayInterval time.Duration `yaml:"outbox-replay-interval" default:"5s" validate:"required"`
+
+	RoutesFile string `yaml:"routes-file" default:"config.yaml" validate:"required"`
+	// RoutesWatchInterval is how often RoutesFile is checked for changes, a SIGHUP reloads it straight away
+	RoutesWatchInterval time.Duration `yaml:"routes-watch-interval" default:"5s" validate:"required"`
+
+	// RateLimitRedisAddr is the redis sharing the rate limits between replicas,
+	// each replica enforces its own limits when it is not set
+	RateLimitRedisAddr     string `yaml:"rate-limit-redis-addr"`
+	RateLimitRedisPassword string `yaml:"rate-limit-redis-password" secret:"true"`
+
+	Addr string `yaml:"addr" default:":80"`
+	// AdminAddr is where the admin API listens, only on the loopback interface by default since it can
+	// change the routes. AdminToken is then the bearer token its requests must carry.
+	AdminAddr  string `yaml:"admin-addr" default:"127.0.0.1:8081"`
+	AdminToken string `yaml:"admin-token" secret:"true"`
+	// OpsAddr serves the health endpoints and the metrics, for the probes and the scrapers
+	OpsAddr        string `yaml:"ops-addr" default:":8082"`
+	TracesExporter string `yaml:"traces-exporter" env:"OTEL_TRACES_EXPORTER" validate:"omitempty,oneof=none otlp stdout"`
+}
@@ -1,22 +1,43 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/go-redis/redis"
 	"github.com/gorilla/mux"
 	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/heetch/MehdiSouilhed-technical-test/common/config"
 	"github.com/heetch/MehdiSouilhed-technical-test/gateway/app/domain"
+	zlog "github.com/rs/zerolog/log"
 )
 
+func logDelivery(d common.Delivery) {
+	if d.Err != nil {
+		zlog.Error().Err(d.Err).Str("traceID", d.Metadata.TraceID).Str("topic", d.Topic).
+			Str("key", d.Key).Dur("latency", d.Latency).Msg("could not deliver message")
+		return
+	}
+
+	zlog.Debug().Str("traceID", d.Metadata.TraceID).Str("topic", d.Topic).Int32("partition", d.Partition).
+		Int64("offset", d.Offset).Dur("latency", d.Latency).Msg("message delivered")
+}
+
 func main() {
+	c := domain.ServiceConfig{}
+	config.MustLoad(&c, "")
+
 	config := sarama.NewConfig()
+	// Record headers, used to carry the message metadata, need at least kafka 0.11
+	config.Version = sarama.V2_3_0_0
 	config.Producer.RequiredAcks = sarama.WaitForAll
 	config.Producer.Retry.Max = 5
-	config.Producer.Retry.Backoff = 5 * time.Second
+	// Requests wait for the sync producer, its retries must fit in the publish timeout of the routes
+	config.Producer.Retry.Backoff = 100 * time.Millisecond
 	config.Producer.Return.Successes = true
 	config.Admin.Timeout = time.Second * 30
 	config.Admin.Retry.Max = 5
@@ -24,29 +45,133 @@ func main() {
 
 	sarama.Logger = log.New(os.Stdout, "[sarama] ", log.LstdFlags)
 
-	time.Sleep(time.Second * 10)
+	// Components are stopped in the reverse order they are added: the servers stop accepting requests,
+	// then the background jobs stop, and the producers flush the messages they hold last
+	lifecycle := common.NewLifecycle(common.DefaultShutdownTimeout)
 
-	producer, err := sarama.NewSyncProducer([]string{"kafka1:9092"}, config)
+	shutdownTracing, err := common.InitTracing(context.Background(), "gateway", c.TracesExporter)
 	if err != nil {
 		panic(err)
 	}
+	lifecycle.OnStop("tracing", shutdownTracing)
+
+	brokers := c.KafkaBrokers
+
+	// The async producer does not hold requests while the broker acknowledges the message,
+	// the outcome of each delivery is logged instead
+	asyncConfig := sarama.NewConfig()
+	asyncConfig.Version = sarama.V2_3_0_0
+	asyncConfig.Producer.RequiredAcks = sarama.WaitForAll
+	asyncConfig.Producer.Retry.Max = 5
+	asyncConfig.Producer.Retry.Backoff = 100 * time.Millisecond
+	asyncConfig.Producer.Return.Successes = true
+	asyncConfig.Producer.Return.Errors = true
 
-	p := common.NewKafkaSender(producer)
+	// The producers connect in the background, until they do the messages of the store-and-forward
+	// routes are kept in the outbox, the other routes fail and the gateway is not ready
+	p := common.NewLazySender()
+	ap := common.NewLazySender()
+	lifecycle.Go("kafka producers", func(ctx context.Context) error {
+		var producer sarama.SyncProducer
+		err := common.Connect(ctx, "kafka producer", common.ConnectPolicy, func() (err error) {
+			producer, err = sarama.NewSyncProducer(brokers, config)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		defer producer.Close()
+		p.Set(common.NewKafkaSender(producer))
 
-	handler, err := domain.NewRequestHandler(p, &http.Client{Timeout: 5 * time.Second}, mux.NewRouter())
+		var asyncProducer sarama.AsyncProducer
+		err = common.Connect(ctx, "kafka async producer", common.ConnectPolicy, func() (err error) {
+			asyncProducer, err = sarama.NewAsyncProducer(brokers, asyncConfig)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		async := common.NewKafkaAsyncSender(asyncProducer, c.MaxInFlight, logDelivery)
+		defer async.Close()
+		ap.Set(async)
+
+		// Once connected, sarama reconnects to the brokers that restart by itself
+		<-ctx.Done()
+		return nil
+	})
+
+	// Each route bounds its requests with its own timeout. The trace context of the proxied requests is
+	// passed on to the upstreams.
+	client := &http.Client{Transport: common.NewTracingTransport(http.DefaultTransport)}
+	handler, err := domain.NewRequestHandler(p, client, mux.NewRouter())
 	if err != nil {
 		panic(err)
 	}
+	handler.SetProducer(domain.ModeAsync, ap)
 
-	configFile, err := domain.ParseFileConfig("config.yaml")
+	if c.RateLimitRedisAddr != "" {
+		client := redis.NewClient(&redis.Options{Addr: c.RateLimitRedisAddr, Password: c.RateLimitRedisPassword})
+		lifecycle.OnStop("rate limit redis", func(context.Context) error {
+			return client.Close()
+		})
+		handler.SetLimiter(domain.NewRedisLimiter(client))
+	}
+
+	outbox, err := common.NewOutbox(c.OutboxDir, c.OutboxMaxMessages, c.OutboxMaxBytes)
+	if err != nil {
+		panic(err)
+	}
+	handler.SetOutbox(outbox)
+
+	lifecycle.Go("outbox", func(ctx context.Context) error {
+		outbox.Run(ctx, p, c.OutboxReplayInterval)
+		return nil
+	})
+
+	routes, err := domain.ParseFileConfig(c.RoutesFile)
 
 	if err != nil {
 		log.Print(err)
 		os.Exit(2)
 	}
 
-	handler.Gateway(configFile)
-	log.Println("Listening on port 80")
+	handler.Gateway(routes)
+
+	// Routes are swapped in as a whole when the routes file changes, an invalid file keeps the current routes
+	watcher := domain.NewConfigWatcher(c.RoutesFile, c.RoutesWatchInterval, handler)
+	lifecycle.Go("config watcher", func(ctx context.Context) error {
+		watcher.Watch(ctx)
+		return nil
+	})
+
+	// The gateway is ready once kafka can be reached and the producers are connected
+	health := common.NewHealth(common.DefaultHealthInterval, common.DefaultHealthTimeout)
+	health.Register("kafka", common.KafkaCheck(brokers))
+	health.Register("kafka producer", p.Check)
+	health.Register("kafka async producer", ap.Check)
+	lifecycle.Go("health", func(ctx context.Context) error {
+		health.Run(ctx)
+		return nil
+	})
+
+	// The probes and the scrapers have their own listener, away from the admin API
+	ops := mux.NewRouter()
+	ops.Handle(common.MetricsPath, common.MetricsHandler())
+	health.Handle(ops)
+	lifecycle.Server("ops", &http.Server{Addr: c.OpsAddr, Handler: ops})
+
+	// Routes added or removed through the admin API are written back to the routes file
+	if c.AdminToken == "" {
+		zlog.Warn().Str("addr", c.AdminAddr).Msg("admin API has no token, it must not be reachable from other hosts")
+	}
+	admin := domain.NewAdmin(handler, c.RoutesFile, c.AdminToken).Router()
+	lifecycle.Server("admin", &http.Server{Addr: c.AdminAddr, Handler: admin})
+
+	lifecycle.Server("gateway", &http.Server{Addr: c.Addr, Handler: handler})
+
 	log.Println("Version 4")
-	log.Fatal(http.ListenAndServe(":80", handler.GetRouter()))
+	if err := lifecycle.Run(context.Background()); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
 }
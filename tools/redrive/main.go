@@ -0,0 +1,62 @@
+// Command redrive reads the messages of a dead-letter topic and publishes them back
+// to the topic they originally failed on, e.g once the bug that made them fail is fixed.
+//
+//	redrive -brokers localhost:9093 -dlq locations-dlq
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+)
+
+func main() {
+	brokers := flag.String("brokers", "kafka1:9092", "comma separated list of kafka brokers")
+	dlq := flag.String("dlq", "locations-dlq", "dead-letter topic to read from")
+	group := flag.String("group", "redrive", "consumer group used to remember which dead letters were re-driven")
+	target := flag.String("target", "", "topic to publish to, defaults to the topic each message failed on")
+	flag.Parse()
+
+	addrs := strings.Split(*brokers, ",")
+
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_3_0_0
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+
+	producer, err := sarama.NewSyncProducer(addrs, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer producer.Close()
+
+	// A dead letter that cannot be re-published is retried a few times and then skipped,
+	// the error is logged with its offset so that it can be re-driven by hand
+	consumer, err := common.NewKafkaGroupConsumerFromConfig(common.ConsumerGroupConfig{
+		Brokers:       addrs,
+		GroupID:       *group,
+		InitialOffset: common.OffsetOldest,
+	}, common.NewRedriver(common.NewKafkaSender(producer), *target), common.WithRetry(common.RetryPolicy{
+		MaxRetries:     3,
+		InitialBackoff: time.Second,
+	}))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The dead letter being re-driven is finished before the producer is closed
+	lifecycle := common.NewLifecycle(common.DefaultShutdownTimeout)
+	lifecycle.Go("consumer", func(ctx context.Context) error {
+		return consumer.Receive(ctx, *dlq)
+	})
+
+	log.Printf("Re-driving messages from %s, press Ctrl+C to stop", *dlq)
+	if err := lifecycle.Run(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+}
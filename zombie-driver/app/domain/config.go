@@ -0,0 +1,15 @@
+package domain
+
+import "time"
+
+// Config holds the settings of the service, loaded by common/config from config.yaml,
+// the environment and the command line
+type Config struct {
+	DriverHost              string        `yaml:"driver-service-host" validate:"required"`
+	DriverLocationsEndpoint string        `yaml:"driver-locations-endpoint" validate:"required"`
+	Timeout                 time.Duration `yaml:"timeout" default:"10s" validate:"required"`
+	MinDistance             float64       `yaml:"minimum-distance" validate:"required"`
+
+	Addr           string `yaml:"addr" default:":80"`
+	TracesExporter string `yaml:"traces-exporter" env:"OTEL_TRACES_EXPORTER" validate:"omitempty,oneof=none otlp stdout"`
+}
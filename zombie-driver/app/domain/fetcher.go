@@ -1,17 +1,40 @@
 package domain
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
 )
 
+// maxProblemBytes is how much of an error answer of driver service is read
+const maxProblemBytes = 1 << 16
+
 type Fetcher interface {
-	GetList(courierID int, minutes int) ([]Coordinates, error)
+	GetList(ctx context.Context, courierID int, minutes int) ([]Coordinates, error)
+}
+
+// LocationsError is returned when driver service answers with an error, Code and Detail are
+// the ones of its problem, empty when it did not send one
+type LocationsError struct {
+	Status int
+	Code   string
+	Detail string
+}
+
+func (e LocationsError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("received http code %d", e.Status)
+	}
+	return fmt.Sprintf("received http code %d: %s: %s", e.Status, e.Code, e.Detail)
 }
 
 type LocationsFetcher struct {
@@ -26,7 +49,7 @@ func NewLocationsFetcher(client *http.Client, url string) *LocationsFetcher {
 	}
 }
 
-func (z LocationsFetcher) GetList(courierID int, minutes int) ([]Coordinates, error) {
+func (z LocationsFetcher) GetList(ctx context.Context, courierID int, minutes int) ([]Coordinates, error) {
 	baseURL, err := url.Parse(fmt.Sprintf("http://"+z.url, courierID))
 	if err != nil {
 		fmt.Println("Malformed URL: ", err.Error())
@@ -37,7 +60,12 @@ func (z LocationsFetcher) GetList(courierID int, minutes int) ([]Coordinates, er
 	params.Add("minutes", strconv.Itoa(minutes))
 	baseURL.RawQuery = params.Encode()
 
-	res, err := z.client.Get(baseURL.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := z.client.Do(req)
 
 	if err != nil {
 		log.Print(err)
@@ -45,8 +73,12 @@ func (z LocationsFetcher) GetList(courierID int, minutes int) ([]Coordinates, er
 	}
 
 	if res.StatusCode != http.StatusOK {
-		log.Printf("received http code %d", res.StatusCode)
-		return nil, fmt.Errorf("received http code %d", res.StatusCode)
+		err := readLocationsError(res)
+		if errClose := res.Body.Close(); errClose != nil {
+			log.Print(errClose)
+		}
+		log.Print(err)
+		return nil, err
 	}
 
 	respBytes, err := ioutil.ReadAll(res.Body)
@@ -70,3 +102,20 @@ func (z LocationsFetcher) GetList(courierID int, minutes int) ([]Coordinates, er
 
 	return latlongs, err
 }
+
+// readLocationsError returns the LocationsError of an error answer of driver service
+func readLocationsError(res *http.Response) LocationsError {
+	e := LocationsError{Status: res.StatusCode}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), common.ContentTypeProblem) {
+		return e
+	}
+
+	p := common.Problem{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxProblemBytes)).Decode(&p); err != nil {
+		log.Print(err)
+		return e
+	}
+	e.Code = p.Code
+	e.Detail = p.Detail
+	return e
+}
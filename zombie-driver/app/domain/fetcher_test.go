@@ -0,0 +1,66 @@
+package domain
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+)
+
+func TestLocationsFetcherErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		status      int
+		body        string
+		expected    LocationsError
+	}{
+		{
+			name:        "problem",
+			contentType: common.ContentTypeProblem,
+			status:      http.StatusBadRequest,
+			body:        `{"status":400,"code":"invalid_request","detail":"query.minutes must be an integer"}`,
+			expected:    LocationsError{Status: http.StatusBadRequest, Code: "invalid_request", Detail: "query.minutes must be an integer"},
+		},
+		{
+			name:        "not a problem",
+			contentType: "text/plain",
+			status:      http.StatusServiceUnavailable,
+			body:        "no healthy upstream",
+			expected:    LocationsError{Status: http.StatusServiceUnavailable},
+		},
+		{
+			name:        "malformed problem",
+			contentType: common.ContentTypeProblem,
+			status:      http.StatusInternalServerError,
+			body:        "{",
+			expected:    LocationsError{Status: http.StatusInternalServerError},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", test.contentType)
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+
+			f := NewLocationsFetcher(server.Client(), strings.TrimPrefix(server.URL, "http://")+"/drivers/%d/locations")
+			_, err := f.GetList(context.Background(), 1, 5)
+
+			locationsErr, ok := err.(LocationsError)
+			if !ok {
+				t.Fatalf("was expecting a LocationsError, got %v", err)
+			}
+			if diff := deep.Equal(locationsErr, test.expected); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package mocks
 
 import (
+	"context"
 	"errors"
 
 	"github.com/heetch/MehdiSouilhed-technical-test/zombie-driver/app/domain"
@@ -8,19 +9,25 @@ import (
 
 type MockFetcher struct {
 	coordinates []domain.Coordinates
-	returnError bool
+	err         error
 }
 
 func NewMockFetcher(c []domain.Coordinates, returnError bool) domain.Fetcher {
-	return MockFetcher{
-		coordinates: c,
-		returnError: returnError,
+	m := MockFetcher{coordinates: c}
+	if returnError {
+		m.err = errors.New("failed to get pings")
 	}
+	return m
 }
 
-func (m MockFetcher) GetList(courierID int, minutes int) ([]domain.Coordinates, error) {
-	if m.returnError {
-		return nil, errors.New("failed to get pings")
+// NewFailingMockFetcher returns a fetcher failing with err
+func NewFailingMockFetcher(err error) domain.Fetcher {
+	return MockFetcher{err: err}
+}
+
+func (m MockFetcher) GetList(ctx context.Context, courierID int, minutes int) ([]domain.Coordinates, error) {
+	if m.err != nil {
+		return nil, m.err
 	}
 
 	return m.coordinates, nil
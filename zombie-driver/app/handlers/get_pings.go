@@ -2,13 +2,18 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/heetch/MehdiSouilhed-technical-test/common"
 	"github.com/heetch/MehdiSouilhed-technical-test/zombie-driver/app/domain"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+var tracer = otel.Tracer("github.com/heetch/MehdiSouilhed-technical-test/zombie-driver/app/handlers")
+
 type RequestHandler struct {
 	intervalMinutes int
 	fetcher         domain.Fetcher
@@ -28,6 +33,9 @@ const (
 	logTraceID     = "traceID"
 )
 
+// CodeLocationsUnavailable is returned when the locations of the driver cannot be fetched
+const CodeLocationsUnavailable = "locations_unavailable"
+
 func NewRequestHandler(
 	interval int,
 	fetcher domain.Fetcher,
@@ -47,15 +55,15 @@ func (s *RequestHandler) GetDriverPings(w http.ResponseWriter, r *http.Request)
 
 	id, err := common.GetIntVariableValue(r, courierID)
 	if err != nil {
-		log.Error().Err(err).Str(logTraceID, traceID)
-		w.WriteHeader(http.StatusBadRequest)
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("invalid driver ID")
+		common.WriteInvalidField(w, "path."+courierID, "must be an integer", traceID)
 		return
 	}
 
 	m, err := common.GetIntParamValue(r, minutes)
 	if err != nil {
-		log.Error().Err(err).Str(logTraceID, traceID)
-		w.WriteHeader(http.StatusBadRequest)
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("invalid minutes")
+		common.WriteInvalidField(w, "query."+minutes, "must be an integer", traceID)
 		return
 	}
 
@@ -63,11 +71,17 @@ func (s *RequestHandler) GetDriverPings(w http.ResponseWriter, r *http.Request)
 		m = defaultMinutes
 	}
 
-	pings, err := s.fetcher.GetList(id, m)
+	pings, err := s.fetcher.GetList(r.Context(), id, m)
 
 	if err != nil {
-		log.Error().Err(err).Str(logTraceID, traceID)
-		w.WriteHeader(http.StatusInternalServerError)
+		// Driver service failing is a bad gateway, its own problem is passed on when it sent one
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not fetch locations")
+		code, detail := CodeLocationsUnavailable, "could not fetch the locations of the driver from driver service"
+		var locationsErr domain.LocationsError
+		if errors.As(err, &locationsErr) && locationsErr.Code != "" {
+			code, detail = locationsErr.Code, locationsErr.Detail
+		}
+		common.WriteError(w, http.StatusBadGateway, code, detail, traceID)
 		return
 	}
 
@@ -76,40 +90,53 @@ func (s *RequestHandler) GetDriverPings(w http.ResponseWriter, r *http.Request)
 	// If there are not a least two coordinates we cannot tell if driver is a zombie
 	if len(pings) <= 1 {
 		log.Info().Str(logTraceID, traceID).Msgf("driver %d does not have enough pings to check if he is zombie (count=%d)", id, len(pings))
+		zombieVerdicts.WithLabelValues(verdictUnknown).Inc()
 		res, err := json.Marshal(response)
 		if err != nil {
-			log.Error().Err(err).Str(logTraceID, traceID)
-			w.WriteHeader(http.StatusBadRequest)
+			log.Error().Err(err).Str(logTraceID, traceID).Msg("could not marshal response")
+			common.WriteError(w, http.StatusInternalServerError, common.CodeInternalError, "could not marshal response", traceID)
 			return
 		}
 
 		_, err = w.Write(res)
 		if err != nil {
-			log.Error().Err(err).Str(logTraceID, traceID)
+			log.Error().Err(err).Str(logTraceID, traceID).Msg("could not write response")
 		}
 		return
 	}
 
 	// Otherwise get the distance that the driver has done
+	_, span := tracer.Start(r.Context(), "zombie decision")
 	distance := s.calculator.SumDistanceList(pings)
 	isZombie := s.detector.IsZombie(distance)
+	span.SetAttributes(
+		attribute.Int("driver.pings", len(pings)),
+		attribute.Float64("driver.distance", distance),
+		attribute.Float64("zombie.minimum_distance", s.detector.MinimumDistance),
+		attribute.Bool("zombie", isZombie),
+	)
+	span.End()
 	response.Zombie = isZombie
 
+	verdict := verdictNotZombie
+	if isZombie {
+		verdict = verdictZombie
+	}
+	zombieVerdicts.WithLabelValues(verdict).Inc()
+
 	log.Info().Str(logTraceID, traceID).Msgf("driver %d has gone %.2f meters the last %d minutes "+
 		"when minimum is %.2f meters and therefore zombie = %t",
 		id, distance, m, s.detector.MinimumDistance, isZombie)
 
 	res, err := json.Marshal(response)
 	if err != nil {
-		log.Error().Err(err).Str(logTraceID, traceID)
-		w.WriteHeader(http.StatusInternalServerError)
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not marshal response")
+		common.WriteError(w, http.StatusInternalServerError, common.CodeInternalError, "could not marshal response", traceID)
 		return
 	}
 	_, err = w.Write(res)
 
 	if err != nil {
-		log.Error().Err(err).Str(logTraceID, traceID)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not write response")
 	}
 }
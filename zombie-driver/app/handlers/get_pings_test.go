@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -9,6 +10,7 @@ import (
 	"github.com/go-test/deep"
 	"github.com/gorilla/mux"
 
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
 	"github.com/heetch/MehdiSouilhed-technical-test/zombie-driver/app/domain"
 	"github.com/heetch/MehdiSouilhed-technical-test/zombie-driver/app/domain/mocks"
 )
@@ -64,7 +66,7 @@ func TestIsDriverZombie(t *testing.T) {
 		{
 			name:         "Dependency returns error",
 			returnErr:    true,
-			expectedCode: http.StatusInternalServerError,
+			expectedCode: http.StatusBadGateway,
 		},
 	}
 
@@ -97,3 +99,50 @@ func TestIsDriverZombie(t *testing.T) {
 		})
 	}
 }
+
+func TestGetDriverPingsProblems(t *testing.T) {
+	tests := []struct {
+		name         string
+		vars         map[string]string
+		query        string
+		err          error
+		expectedCode int
+		expected     string
+		field        string
+	}{
+		{"invalid id", map[string]string{"id": "abc"}, "", nil, http.StatusBadRequest, common.CodeInvalidRequest, "path.id"},
+		{"invalid minutes", map[string]string{"id": "1"}, "?minutes=abc", nil, http.StatusBadRequest, common.CodeInvalidRequest, "query.minutes"},
+		{"dependency cannot be reached", map[string]string{"id": "1"}, "", errors.New("connection refused"), http.StatusBadGateway, CodeLocationsUnavailable, ""},
+		{"dependency answers a problem", map[string]string{"id": "1"}, "",
+			domain.LocationsError{Status: http.StatusInternalServerError, Code: common.CodeInternalError, Detail: "redis is down"},
+			http.StatusBadGateway, common.CodeInternalError, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/drivers/1"+test.query, nil), test.vars)
+			rr := httptest.NewRecorder()
+
+			h := NewRequestHandler(5, mocks.NewFailingMockFetcher(test.err), domain.HaversineDistance{}, domain.ZombieDetector{})
+			h.GetDriverPings(rr, req)
+
+			if rr.Code != test.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, test.expectedCode)
+			}
+
+			p := common.Problem{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+			if p.Code != test.expected || p.TraceID == "" {
+				t.Errorf("was expecting a %s problem with a trace ID, got %+v", test.expected, p)
+			}
+			if locationsErr, ok := test.err.(domain.LocationsError); ok && p.Detail != locationsErr.Detail {
+				t.Errorf("was expecting the detail of driver service %q, got %q", locationsErr.Detail, p.Detail)
+			}
+			if test.field != "" && (len(p.Fields) != 1 || p.Fields[0].Field != test.field) {
+				t.Errorf("was expecting field %s to be invalid, got %+v", test.field, p.Fields)
+			}
+		})
+	}
+}
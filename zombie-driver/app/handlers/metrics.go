@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Values of the verdict label
+const (
+	verdictZombie    = "zombie"
+	verdictNotZombie = "not_zombie"
+	// verdictUnknown is given to the drivers without enough pings to tell
+	verdictUnknown = "unknown"
+)
+
+// zombieVerdicts counts the answers given by GetDriverPings
+var zombieVerdicts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "zombie_driver_verdicts_total",
+	Help: "Zombie checks answered, by verdict.",
+}, []string{"verdict"})
@@ -1,29 +1,42 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
-	"time"
+	"os"
 
 	"github.com/gorilla/mux"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/heetch/MehdiSouilhed-technical-test/common/config"
 	"github.com/heetch/MehdiSouilhed-technical-test/zombie-driver/app/domain"
 	"github.com/heetch/MehdiSouilhed-technical-test/zombie-driver/app/handlers"
 )
 
 func main() {
-	r := mux.NewRouter()
+	c := domain.Config{}
+	config.MustLoad(&c, "config.yaml")
+
+	// The server stops accepting requests and finishes the ones in flight before the spans are flushed
+	lifecycle := common.NewLifecycle(common.DefaultShutdownTimeout)
 
-	c, err := domain.NewConfig("config.yaml")
+	shutdownTracing, err := common.InitTracing(context.Background(), "zombie-driver", c.TracesExporter)
 	if err != nil {
 		panic(err)
 	}
+	lifecycle.OnStop("tracing", shutdownTracing)
+
+	r := mux.NewRouter()
 
 	// build driver service base url
 	driverHost := fmt.Sprintf("%s/%s", c.DriverHost, c.DriverLocationsEndpoint)
 
 	// fetcher is the client that makes the call to driver service
-	fetcher := domain.NewLocationsFetcher(&http.Client{Timeout: c.Timeout * time.Second}, driverHost)
+	fetcher := domain.NewLocationsFetcher(&http.Client{
+		Timeout:   c.Timeout,
+		Transport: common.NewTracingTransport(http.DefaultTransport),
+	}, driverHost)
 
 	// Defining how we will calculate distance - here it is Haversine method
 	calculator := domain.HaversineDistance{}
@@ -35,7 +48,23 @@ func main() {
 	handler := handlers.NewRequestHandler(5, fetcher, calculator, detector)
 
 	r.HandleFunc("/drivers/{id}", handler.GetDriverPings)
+	r.Handle(common.MetricsPath, common.MetricsHandler())
 
-	log.Print("Listening on port 80")
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", 80), r))
+	// The service is ready once driver service is, being up is not enough for it to serve the locations
+	health := common.NewHealth(common.DefaultHealthInterval, common.DefaultHealthTimeout)
+	health.Register("driver-location", common.HTTPCheck(http.DefaultClient, fmt.Sprintf("http://%s%s", c.DriverHost, common.ReadinessPath)))
+	health.Handle(r)
+	lifecycle.Go("health", func(ctx context.Context) error {
+		health.Run(ctx)
+		return nil
+	})
+
+	r.Use(common.HTTPTracing, common.HTTPMetrics)
+
+	lifecycle.Server("http", &http.Server{Addr: c.Addr, Handler: r})
+
+	if err := lifecycle.Run(context.Background()); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
 }